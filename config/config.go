@@ -48,9 +48,90 @@ type (
 		DB       uint8  `yaml:"db"`
 	}
 
+	PIT struct {
+		Index     string `yaml:"index"`
+		Pool      uint64 `yaml:"pool"`
+		KeepAlive uint64 `yaml:"keep_alive"` // 秒
+		Rotation  uint64 `yaml:"rotation"`   // 秒，不小于 15，旧 pit 要在下一次轮换前关闭
+	}
+
+	Rollover struct {
+		Shards     uint64 `yaml:"shards"`
+		Replicas   uint64 `yaml:"replicas"`
+		Interval   uint64 `yaml:"interval"` // 秒
+		MaxAge     string `yaml:"max_age"`
+		MaxDocs    uint64 `yaml:"max_docs"`
+		MaxSize    string `yaml:"max_size"`    // 单个主分片大小
+		MaxIndices uint64 `yaml:"max_indices"` // 0 不清理
+	}
+
+	Ingest struct {
+		BatchSize  int `yaml:"batch_size"`
+		Interval   int `yaml:"interval"` // 毫秒
+		MaxRetries int `yaml:"max_retries"`
+		Queue      int `yaml:"queue"`
+	}
+
+	Ranking struct {
+		Relevance float64 `yaml:"relevance"`
+		Score     float64 `yaml:"score"`
+		Media     float64 `yaml:"media"`
+		Recency   float64 `yaml:"recency"`
+		Scale     string  `yaml:"scale"` // 如 30d
+		Decay     float64 `yaml:"decay"`
+	}
+
+	Cache struct {
+		Size  int  `yaml:"size"` // 进程内缓存的条数，0 不缓存
+		TTL   int  `yaml:"ttl"`  // 秒，不超过 pit 的轮换间隔
+		Redis bool `yaml:"redis"`
+	}
+
+	Profile struct {
+		Name    string   `yaml:"name"`
+		Label   string   `yaml:"label"`
+		Sort    []string `yaml:"sort"`    // field:order，如 _score:desc
+		Ranking Ranking  `yaml:"ranking"` // 不配置时使用 search.ranking
+	}
+
+	Search struct {
+		PIT      []PIT     `yaml:"pit"`
+		Rollover Rollover  `yaml:"rollover"`
+		Ingest   Ingest    `yaml:"ingest"`
+		Ranking  Ranking   `yaml:"ranking"`
+		Profiles []Profile `yaml:"profiles"`
+		Cache    Cache     `yaml:"cache"`
+	}
+
+	Pool struct {
+		Name    string `yaml:"name"` // search、menu、analytics
+		Workers int    `yaml:"workers"`
+		Queue   int    `yaml:"queue"` // 排队的上限，满了之后直接回复繁忙
+	}
+
+	Worker struct {
+		Pools []Pool `yaml:"pools"`
+	}
+
+	Mission struct {
+		Mode       string `yaml:"mode"` // core 或 jetstream
+		Stream     string `yaml:"stream"`
+		Durable    string `yaml:"durable"`
+		MaxDeliver int    `yaml:"max_deliver"`
+		AckWait    int    `yaml:"ack_wait"`  // 秒，排队和执行期间每半个周期延长一次
+		NakDelay   int    `yaml:"nak_delay"` // 毫秒
+		DeadLetter string `yaml:"dead_letter"`
+	}
+
+	Admin struct {
+		Name  string `yaml:"name"`  // 审计记录中的操作人
+		Token string `yaml:"token"` // Authorization: Bearer <token>
+	}
+
 	Web struct {
-		Prefix  string `yaml:"prefix"`
-		Address string `yaml:"address"`
+		Prefix  string  `yaml:"prefix"`
+		Address string  `yaml:"address"`
+		Admins  []Admin `yaml:"admins"` // 写入、下架、迁移等管理接口的调用方，为空时管理接口全部拒绝
 	}
 
 	Configuration struct {
@@ -61,6 +142,9 @@ type (
 		Elasticsearch Elasticsearch `yaml:"elasticsearch"`
 		Nats          Nats          `yaml:"nats"`
 		Redis         Redis         `yaml:"redis"`
+		Search        Search        `yaml:"search"`
+		Worker        Worker        `yaml:"worker"`
+		Mission       Mission       `yaml:"mission"`
 		Web           Web           `yaml:"web"`
 		Runtime       Runtime       `yaml:"runtime"`
 		Build         Build         `yaml:"build"`
@@ -15,43 +15,58 @@ import (
 )
 
 var (
-	_server  *http.Server
-	_close   = make(chan struct{})
-	_done    = make(chan struct{})
-	_channel = make(chan SSMRequestMsg, 10000)
-	_check   = make(chan SSMRequestMsg, 10000)
+	_server *http.Server
+	_close  = make(chan struct{})
+	_done   = make(chan struct{})
 )
 
-func Init(prefix, addr string) error {
+func Init(prefix, addr string, admins []AdminConfig, sc search.Config, pools []PoolConfig, mc MissionConfig) error {
 	logger.App().Infoln("=================================================== start init core ===================================================")
 	defer logger.App().Infoln("=================================================== stop init core ===================================================")
 
-	// ============= es mapping
+	// ============= search
 
-	if err := initESMapping(); err != nil {
+	if err := search.Init(sc); err != nil {
 		return err
 	}
 
-	// ============= search
+	search.OnIndexed(publishEviction)
 
-	if err := search.Init("message", 10); err != nil {
+	// ============= es mapping
+
+	if err := initESMapping(); err != nil {
 		return err
 	}
 
-	go parseAndStore()
+	initPools(pools)
+
+	go runPools()
 	go flushRankList()
-	go checkAndPin()
 	// ============= web test
 
 	gin.DefaultWriter = logger.GinWriter(logrus.Fields{"component": "search-web"})
 	gin.SetMode(gin.DebugMode)
 
+	// token 为空的管理员不生效
+	_admins = make([]AdminConfig, 0, len(admins))
+	for _, admin := range admins {
+		if admin.Name != "" && admin.Token != "" {
+			_admins = append(_admins, admin)
+		}
+	}
+
 	engine := gin.New()
 	engine.Use(gin.Recovery(), gin.Logger())
 
 	grouper := engine.Group(prefix)
 
 	grouper.POST("/search", doSearch)
+	grouper.GET("/suggest", doWebSuggest)
+	grouper.GET("/stats", doStats)
+	grouper.POST("/admin/migrate/:index", adminAuth, doMigrate)
+	grouper.POST("/ingest/message", adminAuth, doWebIngestMessage)
+	grouper.POST("/ingest/cog", adminAuth, doWebIngestCog)
+	grouper.POST("/takedown", adminAuth, doWebTakedown)
 
 	_server = &http.Server{Addr: addr, Handler: engine}
 
@@ -63,6 +78,13 @@ func Init(prefix, addr string) error {
 		logger.App().Infof("=========== subscribe to [%s] success ===========", JSSearchCacheSubject)
 	}
 
+	if subscription, err := nats.Instance().Subscribe(SSCacheEvictSubject, doCacheEvict); err != nil {
+		return err
+	} else {
+		_subscriptions = append(_subscriptions, subscription)
+		logger.App().Infof("=========== subscribe to [%s] success ===========", SSCacheEvictSubject)
+	}
+
 	if subscription, err := nats.Instance().Subscribe(JSSearchImpSubject, doImpressions); err != nil {
 		return err
 	} else {
@@ -70,11 +92,48 @@ func Init(prefix, addr string) error {
 		logger.App().Infof("=========== subscribe to [%s] success ===========", JSSearchImpSubject)
 	}
 
-	if subscription, err := nats.Instance().QueueSubscribe(SSMissionRequestSubject, SSQueue, doRequest); err != nil {
+	if subscription, err := subscribeMission(mc); err != nil {
 		return err
 	} else {
 		_subscriptions = append(_subscriptions, subscription)
-		logger.App().Infof("=========== subscribe to [%s]-[%s] success ===========", SSMissionRequestSubject, SSQueue)
+		logger.App().Infof("=========== subscribe to [%s]-[%s] in %s mode success ===========", SSMissionRequestSubject, SSQueue, _mission.Mode)
+	}
+
+	if _mission.Mode == MissionModeJetStream {
+		if subscription, err := subscribeMaxDeliveries(); err != nil {
+			return err
+		} else {
+			_subscriptions = append(_subscriptions, subscription)
+			logger.App().Infof("=========== subscribe to [%s] success ===========", subscription.Subject)
+		}
+	}
+
+	if subscription, err := nats.Instance().QueueSubscribe(SSIngestMessageSubject, SSQueue, doIngestMessage); err != nil {
+		return err
+	} else {
+		_subscriptions = append(_subscriptions, subscription)
+		logger.App().Infof("=========== subscribe to [%s]-[%s] success ===========", SSIngestMessageSubject, SSQueue)
+	}
+
+	if subscription, err := nats.Instance().QueueSubscribe(SSIngestCogSubject, SSQueue, doIngestCog); err != nil {
+		return err
+	} else {
+		_subscriptions = append(_subscriptions, subscription)
+		logger.App().Infof("=========== subscribe to [%s]-[%s] success ===========", SSIngestCogSubject, SSQueue)
+	}
+
+	if subscription, err := nats.Instance().QueueSubscribe(SSTakedownSubject, SSQueue, doTakedown); err != nil {
+		return err
+	} else {
+		_subscriptions = append(_subscriptions, subscription)
+		logger.App().Infof("=========== subscribe to [%s]-[%s] success ===========", SSTakedownSubject, SSQueue)
+	}
+
+	if subscription, err := nats.Instance().QueueSubscribe(SSSuggestSubject, SSQueue, doSuggest); err != nil {
+		return err
+	} else {
+		_subscriptions = append(_subscriptions, subscription)
+		logger.App().Infof("=========== subscribe to [%s]-[%s] success ===========", SSSuggestSubject, SSQueue)
 	}
 
 	return nil
@@ -106,17 +165,18 @@ func Shutdown() error {
 		}
 	}
 
-	if err := search.Shutdown(); err != nil {
-		return err
+	// 先停止接收请求并等待执行中的请求完成，最后关闭 pit 和写入队列，避免执行中的请求访问已关闭的资源
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(5))
+	defer cancel()
+	if err := _server.Shutdown(ctx); err != nil {
+		logger.App().Errorf("shutdown web server error : %s", err.Error())
 	}
 
 	close(_close)
 
 	<-_done
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(5))
-	defer cancel()
-	return _server.Shutdown(ctx)
+	return search.Shutdown()
 }
 
 func LoadCache() error {
@@ -135,5 +195,27 @@ func LoadCache() error {
 		return err
 	}
 
+	// 启动时先于 Init 加载，表要在这里建
+	if err := initTakedownTables(); err != nil {
+		return err
+	}
+
+	if err := loadBlocklist(); err != nil {
+		return err
+	}
+
+	if err := loadVocabulary(); err != nil {
+		return err
+	}
+
+	// 索引的查询分析器引用了同义词集合，要在 Init 建索引之前写入
+	if err := initSynonymTable(); err != nil {
+		return err
+	}
+
+	if err := loadSynonyms(); err != nil {
+		return err
+	}
+
 	return nil
 }
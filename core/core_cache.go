@@ -1,14 +1,18 @@
 package core
 
 import (
+	"context"
 	"fmt"
 	"jarvis/dao/db/mysql"
+	"jarvis/dao/db/redis"
 	"jarvis/logger"
 	"jarvis/middleware/mq/nats"
 	"operate-backend/core/structure"
+	"search-service/core/search"
 	"sync"
 	"time"
 
+	"github.com/spf13/cast"
 	"gorm.io/gorm"
 )
 
@@ -254,3 +258,25 @@ func doADImpressions(aid uint) {
 		ad.Impressions += 1
 	}
 }
+
+// loadVocabulary 把 SearchHash 中出现过多次的词交给 search 做纠错兜底
+func loadVocabulary() error {
+	values, err := redis.Instance().HGetAll(context.Background(), "SearchHash").Result()
+	if err != nil {
+		return err
+	}
+
+	words := make(map[string]int64, len(values))
+	for word, value := range values {
+		// 只出现过一次的多半是打错的词
+		if count := cast.ToInt64(value); count >= 2 {
+			words[word] = count
+		}
+	}
+
+	search.SetVocabulary(words)
+
+	logger.App().Infof("======= load vocabulary success : %d", len(words))
+
+	return nil
+}
@@ -2,78 +2,145 @@ package core
 
 import (
 	"errors"
-	"jarvis/dao/db/elasticsearch"
+	"fmt"
 	"jarvis/logger"
-	"strings"
+	"search-service/core/search"
 )
 
+// 修改 mapping 时同步递增 _meta.version，启动时会提示需要迁移的索引
+var _mappings = map[string]string{
+	search.IndexCog:      _cogMap,
+	search.SeriesMessage: _messageMap,
+	search.IndexBot:      _botMap,
+}
+
+// mapping 用到的分析插件，ik 分词和 stconvert 繁简转换
+var _plugins = []string{"analysis-ik", "analysis-stconvert"}
+
 func initESMapping() error {
+	if err := search.RequirePlugins(_plugins...); err != nil {
+		return err
+	}
+
 	// 1. cog
-	if err := initMapping("cog", _cogMap); err != nil {
+	if err := initMapping(search.IndexCog, _cogMap); err != nil {
 		return err
 	}
 
 	logger.App().Infoln("=================== index cog ===================")
 
-	// 2. message
-	if err := initMapping("message", _messageMap); err != nil {
+	// 2. message 按模板滚动，写入 message-write，查询 message-read
+	if err := search.EnsureRollover(search.SeriesMessage, _messageMap); err != nil {
+		return err
+	}
+
+	if err := search.CheckMapping(search.IndexMessage, _messageMap); err != nil {
 		return err
 	}
 
 	logger.App().Infoln("=================== index message ===================")
 
+	// 3. bot
+	if err := initMapping(search.IndexBot, _botMap); err != nil {
+		return err
+	}
+
+	logger.App().Infoln("=================== index bot ===================")
+
 	return nil
 }
 
 func initMapping(indexName, mapping string) error {
-	eRsp, eErr := elasticsearch.Instance().Indices.Exists([]string{indexName})
-	if eErr != nil {
-		return eErr
+	if err := search.EnsureIndex(indexName, mapping); err != nil {
+		return err
+	}
+
+	return search.CheckMapping(indexName, mapping)
+}
+
+// Migrate 把索引 reindex 到当前版本的 mapping 后切换别名
+func Migrate(index string) error {
+	mapping, exist := _mappings[index]
+	if !exist {
+		return errors.New(fmt.Sprintf("unknown index [%s]", index))
 	}
-	defer func() { _ = eRsp.Body.Close() }()
-
-	if eRsp.StatusCode == 404 {
-		cRsp, cErr := elasticsearch.Instance().Indices.Create(indexName, elasticsearch.Instance().Indices.Create.WithBody(strings.NewReader(mapping)))
-		if cErr != nil {
-			return cErr
-		}
-		defer func() { _ = cRsp.Body.Close() }()
-
-		if cRsp.IsError() {
-			return errors.New(cRsp.String())
-		}
-
-		return nil
-	} else if eRsp.StatusCode == 200 {
-		return nil
+
+	if index == search.SeriesMessage {
+		return search.MigrateRollover(index, mapping)
 	}
 
-	return errors.New(eRsp.String())
+	return search.MigrateIndex(index, mapping)
 }
 
-// number_of_shards make it more to 100
+// 作为 message-* 的模板使用，分片数和副本数由 search.rollover 覆盖
 const _messageMap = `{
   "settings": {
     "number_of_shards": 1,  
     "number_of_replicas": 1,  
-    "index.queries.cache.enabled": true 
+    "index.queries.cache.enabled": true,
+    "analysis": {
+      "char_filter": {
+        "t2s": {
+          "type": "stconvert",
+          "convert_type": "t2s"
+        }
+      },
+      "filter": {
+        "search_synonym": {
+          "type": "synonym_graph",
+          "synonyms_set": "search-synonyms",
+          "updateable": true
+        }
+      },
+      "analyzer": {
+        "ik_index": {
+          "type": "custom",
+          "char_filter": ["t2s"],
+          "tokenizer": "ik_max_word"
+        },
+        "ik_search": {
+          "type": "custom",
+          "char_filter": ["t2s"],
+          "tokenizer": "ik_smart",
+          "filter": ["search_synonym"]
+        }
+      }
+    }
   },
   "mappings": {
+    "_meta": {
+      "version": 6
+    },
     "properties": {
       "id": {
         "type": "keyword"
       },
       "content": {
         "type": "text",
-        "analyzer": "ik_max_word",      
-        "search_analyzer": "ik_smart",   
+        "analyzer": "ik_index",
+        "search_analyzer": "ik_search",
         "fields": {
           "keyword": {
             "type": "keyword",
             "ignore_above": 256         
+          },
+          "en": {
+            "type": "text",
+            "analyzer": "english"
+          },
+          "ru": {
+            "type": "text",
+            "analyzer": "russian"
+          },
+          "fa": {
+            "type": "text",
+            "analyzer": "persian"
           }
         }
       },
+      "lang": {
+        "type": "keyword"
+      },
       "link": {
         "type": "keyword"
       },
@@ -91,6 +158,17 @@ const _messageMap = `{
       },
       "files": {
         "type": "integer"               
+      },
+      "nsfw": {
+        "type": "boolean"
+      },
+      "posted_at": {
+        "type": "date",
+        "format": "epoch_millis"
+      },
+      "suggest": {
+        "type": "completion",
+        "analyzer": "simple"
       }
     }
   }
@@ -99,29 +177,125 @@ const _messageMap = `{
 const _cogMap = `{
   "settings": {
     "number_of_shards": 1,  
-    "number_of_replicas": 1  
+    "number_of_replicas": 1,
+    "analysis": {
+      "char_filter": {
+        "t2s": {
+          "type": "stconvert",
+          "convert_type": "t2s"
+        }
+      },
+      "filter": {
+        "search_synonym": {
+          "type": "synonym_graph",
+          "synonyms_set": "search-synonyms",
+          "updateable": true
+        }
+      },
+      "analyzer": {
+        "ik_index": {
+          "type": "custom",
+          "char_filter": ["t2s"],
+          "tokenizer": "ik_max_word"
+        },
+        "ik_search": {
+          "type": "custom",
+          "char_filter": ["t2s"],
+          "tokenizer": "ik_smart",
+          "filter": ["search_synonym"]
+        }
+      }
+    }
   },
   "mappings": {
+    "_meta": {
+      "version": 5
+    },
     "properties": {
       "id": {
         "type": "keyword"
       },
       "title": {
         "type": "text",
-        "analyzer": "ik_max_word",      
-        "search_analyzer": "ik_smart",   
+        "analyzer": "ik_index",
+        "search_analyzer": "ik_search",
         "fields": {
           "keyword": {
             "type": "keyword",
             "ignore_above": 256         
+          },
+          "en": {
+            "type": "text",
+            "analyzer": "english"
+          },
+          "ru": {
+            "type": "text",
+            "analyzer": "russian"
+          },
+          "fa": {
+            "type": "text",
+            "analyzer": "persian"
           }
         }
       },
+      "lang": {
+        "type": "keyword"
+      },
+      "type": {
+        "type": "byte"
+      },
+      "link": {
+        "type": "keyword"
+      },
       "members": {
         "type": "integer"               
       },
       "messages": {
         "type": "integer"               
+      },
+      "nsfw": {
+        "type": "boolean"
+      },
+      "suggest": {
+        "type": "completion",
+        "analyzer": "simple"
+      }
+    }
+  }
+}`
+
+const _botMap = `{
+  "settings": {
+    "number_of_shards": 1,
+    "number_of_replicas": 1
+  },
+  "mappings": {
+    "_meta": {
+      "version": 1
+    },
+    "properties": {
+      "id": {
+        "type": "keyword"
+      },
+      "username": {
+        "type": "keyword",
+        "fields": {
+          "text": {
+            "type": "text",
+            "analyzer": "standard"
+          }
+        }
+      },
+      "description": {
+        "type": "text",
+        "analyzer": "ik_max_word",
+        "search_analyzer": "ik_smart"
+      },
+      "category": {
+        "type": "keyword"
+      },
+      "score": {
+        "type": "integer"
       }
     }
   }
@@ -0,0 +1,158 @@
+package core
+
+import (
+	"errors"
+	"jarvis/logger"
+	"jarvis/middleware/mq/nats"
+	"net/http"
+	"search-service/core/search"
+
+	"github.com/bytedance/sonic"
+	"github.com/gin-gonic/gin"
+	ONats "github.com/nats-io/nats.go"
+)
+
+const (
+	SSIngestMessageSubject = "Search.Ingest.Message"
+	SSIngestCogSubject     = "Search.Ingest.Cog"
+
+	// 所有实例都订阅，清理进程内缓存中包含这些 link 的结果
+	SSCacheEvictSubject = "Search.Cache.Evict"
+)
+
+// IngestResponse 写入结果，accepted 为进入写入队列的条数
+type IngestResponse struct {
+	Accepted int               `json:"accepted"`
+	Rejected []search.Rejected `json:"rejected"`
+	Error    string            `json:"error"`
+}
+
+func ingestMessages(data []byte) (*IngestResponse, error) {
+	docs, err := search.DecodeDocuments[search.MessageDocument](data)
+	if err != nil {
+		return &IngestResponse{Rejected: []search.Rejected{}, Error: err.Error()}, err
+	}
+
+	accepted, rejected, err := search.IngestMessages(docs)
+
+	return newIngestResponse(accepted, rejected, err), err
+}
+
+func ingestCogs(data []byte) (*IngestResponse, error) {
+	docs, err := search.DecodeDocuments[search.CogDocument](data)
+	if err != nil {
+		return &IngestResponse{Rejected: []search.Rejected{}, Error: err.Error()}, err
+	}
+
+	accepted, rejected, err := search.IngestCogs(docs)
+
+	return newIngestResponse(accepted, rejected, err), err
+}
+
+func newIngestResponse(accepted int, rejected []search.Rejected, err error) *IngestResponse {
+	response := &IngestResponse{Accepted: accepted, Rejected: rejected}
+	if err != nil {
+		response.Error = err.Error()
+	}
+
+	return response
+}
+
+// publishEviction 写入成功后由 search.OnIndexed 调用，本实例和 redis 已经清理过，通知其他实例清理各自的进程内缓存
+func publishEviction(links []string) {
+	if len(links) == 0 {
+		return
+	}
+
+	data, err := sonic.Marshal(links)
+	if err != nil {
+		logger.App().Errorf("marshal eviction error : %s", err.Error())
+		return
+	}
+
+	if err = nats.Instance().Publish(SSCacheEvictSubject, data); err != nil {
+		logger.App().Errorf("publish eviction error : %s", err.Error())
+	}
+}
+
+// ========================================================================================================
+
+func doCacheEvict(msg *ONats.Msg) {
+	links := make([]string, 0)
+	if err := sonic.Unmarshal(msg.Data, &links); err != nil {
+		logger.App().Errorf("unmarshal eviction error : %s - %s", err.Error(), string(msg.Data))
+		return
+	}
+
+	search.EvictCache(links...)
+}
+
+func doIngestMessage(msg *ONats.Msg) {
+	response, err := ingestMessages(msg.Data)
+	if err != nil {
+		logger.App().Errorf("ingest message error : %s", err.Error())
+	}
+
+	doIngestReply(msg, response)
+}
+
+func doIngestCog(msg *ONats.Msg) {
+	response, err := ingestCogs(msg.Data)
+	if err != nil {
+		logger.App().Errorf("ingest cog error : %s", err.Error())
+	}
+
+	doIngestReply(msg, response)
+}
+
+// doIngestReply 发送方用 request 时回复写入结果
+func doIngestReply(msg *ONats.Msg, response *IngestResponse) {
+	if msg.Reply == "" {
+		return
+	}
+
+	data, err := sonic.Marshal(response)
+	if err != nil {
+		logger.App().Errorf("marshal ingest response error : %s", err.Error())
+		return
+	}
+
+	if err = msg.Respond(data); err != nil {
+		logger.App().Errorf("respond ingest error : %s", err.Error())
+	}
+}
+
+// ========================================================================================================
+
+func doWebIngestMessage(ctx *gin.Context) {
+	data, err := ctx.GetRawData()
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid body: " + err.Error()})
+		return
+	}
+
+	response, err := ingestMessages(data)
+	ctx.JSON(ingestStatus(err), response)
+}
+
+func doWebIngestCog(ctx *gin.Context) {
+	data, err := ctx.GetRawData()
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid body: " + err.Error()})
+		return
+	}
+
+	response, err := ingestCogs(data)
+	ctx.JSON(ingestStatus(err), response)
+}
+
+func ingestStatus(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, search.ErrIngestBusy):
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusBadRequest
+}
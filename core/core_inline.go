@@ -0,0 +1,157 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"jarvis/dao/db/redis"
+	"jarvis/logger"
+	"search-service/core/search"
+	"strings"
+	"time"
+
+	"github.com/bytedance/sonic"
+	ORedis "github.com/redis/go-redis/v9"
+)
+
+// inline 翻页游标的有效期，和按钮翻页的 Sorts 一致
+const inlineOffsetExpire = time.Second * time.Duration(180)
+
+// InlineResult 对应 Telegram 的 InlineQueryResultArticle
+type InlineResult struct {
+	Type                string               `json:"type"`
+	ID                  string               `json:"id"`
+	Title               string               `json:"title"`
+	Description         string               `json:"description"`
+	URL                 string               `json:"url"`
+	InputMessageContent InlineMessageContent `json:"input_message_content"`
+}
+
+type InlineMessageContent struct {
+	MessageText string `json:"message_text"`
+}
+
+func handleInline(request *SSMRequestMsg) {
+	response := &SSMResponseMsg{
+		Type:    RTInline,
+		TraceID: request.TraceID, UserID: request.UserID, Username: request.Username, ChatID: request.ChatID, InMsgID: request.InMsgID, OutMsgID: request.OutMsgID,
+		Markup:        map[string]any{},
+		InlineQueryID: request.InlineQueryID,
+		Results:       []InlineResult{},
+	}
+
+	if results, offset, err := inline(request.UserID, request.Language, request.Content, request.Offset); err != nil {
+		response.Error = err.Error()
+		logger.App().Errorf("[%s] inline error : %s", response.TraceID, err.Error())
+	} else {
+		response.Results = results
+		response.NextOffset = offset
+	}
+
+	if err := doReplySSMResponse(request, response); err != nil {
+		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
+	}
+}
+
+// inline 搜索全部类型，offset 是上一页保存的游标 token，返回结果和下一页的 token
+func inline(userID int, language, text, offset string) ([]InlineResult, string, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return []InlineResult{}, "", nil
+	}
+
+	sorts := []any{}
+	if offset != "" {
+		var err error
+		if sorts, err = getInlineOffset(offset); err != nil {
+			return nil, "", err
+		}
+		// 游标过期，不再继续翻页
+		if sorts == nil {
+			return []InlineResult{}, "", nil
+		}
+	}
+
+	result, err := search.Search(0, text, sorts, search.Options{NSFW: !getSafeSearch(userID), Language: language})
+	if err != nil {
+		// 操作符写错的不报错，只是没有结果
+		if oe := new(search.OperatorError); errors.As(err, &oe) {
+			return []InlineResult{}, "", nil
+		}
+		return nil, "", err
+	}
+
+	results := make([]InlineResult, 0, len(result.Content))
+	for _, item := range result.Content {
+		results = append(results, InlineResult{
+			Type:        "article",
+			ID:          inlineResultID(item.Link),
+			Title:       item.Text,
+			Description: item.Link,
+			URL:         item.Link,
+			InputMessageContent: InlineMessageContent{
+				MessageText: fmt.Sprintf("%s\n%s", item.Text, item.Link),
+			},
+		})
+	}
+
+	if !result.Next || len(result.LastSort) == 0 {
+		return results, "", nil
+	}
+
+	next, err := saveInlineOffset(result.LastSort)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return results, next, nil
+}
+
+// inlineResultID Telegram 要求同一次回答里 id 唯一且不超过 64 字节
+func inlineResultID(link string) string {
+	id := strings.TrimPrefix(link, "https://t.me/")
+	if len(id) > 64 {
+		id = id[len(id)-64:]
+	}
+	return id
+}
+
+// saveInlineOffset next_offset 最多 64 字节，游标存在 redis 里，只把 token 交给 Telegram
+func saveInlineOffset(sorts []any) (string, error) {
+	data, err := sonic.MarshalString(sorts)
+	if err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, 8)
+	if _, err = rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	if err = redis.Instance().Set(context.Background(), fmt.Sprintf("InlineOffset:%s", token), data, inlineOffsetExpire).Err(); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// getInlineOffset 游标不存在或已过期时返回 nil
+func getInlineOffset(token string) ([]any, error) {
+	data, err := redis.Instance().Get(context.Background(), fmt.Sprintf("InlineOffset:%s", token)).Result()
+	if err != nil {
+		if err == ORedis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	sorts := make([]any, 0)
+	if err = sonic.UnmarshalString(data, &sorts); err != nil {
+		return nil, err
+	}
+
+	return sorts, nil
+}
@@ -0,0 +1,311 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"jarvis/logger"
+	"jarvis/middleware/mq/nats"
+	"sync"
+	"time"
+
+	"github.com/bytedance/sonic"
+	ONats "github.com/nats-io/nats.go"
+	"github.com/spf13/cast"
+)
+
+const (
+	// MissionReplyHeader jetstream 模式下用 request 发送只会收到流的 PubAck，需要回复的调用方把 inbox 放在这个 header 里用 publish 发送
+	MissionReplyHeader = "Search-Reply"
+
+	MissionModeCore      = "core"      // QueueSubscribe，实例重启期间的请求会丢失
+	MissionModeJetStream = "jetstream" // 持久化的 durable consumer，处理完才 ack
+
+	missionMaxAge = time.Hour // 流里的请求最多保留这么久，再久回复也没有意义了
+
+	// ack 超时的次数达到 MaxDeliver 后服务端不再投递，只发这个通知，参数为 stream 和 durable
+	missionMaxDeliveriesSubject = "$JS.EVENT.ADVISORY.CONSUMER.MAX_DELIVERIES.%s.%s"
+	reasonMaxDeliveries         = "max deliveries"
+)
+
+var (
+	_mission      = MissionConfig{Mode: MissionModeCore}
+	_missionMutex = new(sync.Mutex)
+	_missionStats = MissionStats{}
+)
+
+type MissionConfig struct {
+	Mode       string
+	Stream     string
+	Durable    string
+	MaxDeliver int
+	AckWait    time.Duration
+	NakDelay   time.Duration // 池满时延迟多久重新投递
+	DeadLetter string        // 超过投递次数或无法解析的请求转发到这里
+}
+
+type MissionStats struct {
+	Mode       string `json:"mode"`
+	Acked      uint64 `json:"acked"`
+	Naked      uint64 `json:"naked"`
+	Redelivery uint64 `json:"redelivery"`
+	DeadLetter uint64 `json:"dead_letter"`
+}
+
+// subscribeMission 按配置选择 core NATS 或 JetStream 订阅 Search.Mission.Request
+func subscribeMission(config MissionConfig) (*ONats.Subscription, error) {
+	if config.Mode == "" {
+		config.Mode = MissionModeCore
+	}
+	if config.Stream == "" {
+		config.Stream = "SEARCH_MISSION"
+	}
+	if config.Durable == "" {
+		config.Durable = SSQueue
+	}
+	if config.MaxDeliver <= 0 {
+		config.MaxDeliver = 3
+	}
+	if config.AckWait <= 0 {
+		config.AckWait = time.Second * time.Duration(30)
+	}
+	if config.NakDelay <= 0 {
+		config.NakDelay = time.Second
+	}
+	if config.DeadLetter == "" {
+		config.DeadLetter = SSMissionDeadLetterSubject
+	}
+
+	_mission = config
+	_missionStats.Mode = config.Mode
+
+	switch config.Mode {
+	case MissionModeCore:
+		return nats.Instance().QueueSubscribe(SSMissionRequestSubject, SSQueue, doRequest)
+	case MissionModeJetStream:
+		js, err := nats.Instance().JetStream()
+		if err != nil {
+			return nil, err
+		}
+
+		if err = ensureMissionStream(js, config.Stream); err != nil {
+			return nil, err
+		}
+
+		if err = ensureMissionConsumer(js, config); err != nil {
+			return nil, err
+		}
+
+		// Bind 到已有的 consumer，Unsubscribe 时库不会删除它，重启期间的请求留在流里
+		return js.QueueSubscribe(SSMissionRequestSubject, SSQueue, doStreamRequest,
+			ONats.Bind(config.Stream, config.Durable),
+			ONats.ManualAck(),
+		)
+	}
+
+	return nil, errors.New(fmt.Sprintf("mission mode must be %s or %s", MissionModeCore, MissionModeJetStream))
+}
+
+// ensureMissionStream 流不存在时创建，已存在时不修改，避免覆盖运维调整过的配置
+func ensureMissionStream(js ONats.JetStreamContext, name string) error {
+	if _, err := js.StreamInfo(name); err == nil {
+		return nil
+	} else if !errors.Is(err, ONats.ErrStreamNotFound) {
+		return err
+	}
+
+	_, err := js.AddStream(&ONats.StreamConfig{
+		Name:      name,
+		Subjects:  []string{SSMissionRequestSubject},
+		Retention: ONats.WorkQueuePolicy,
+		Storage:   ONats.FileStorage,
+		MaxAge:    missionMaxAge,
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.App().Infof("create stream [%s] for [%s]", name, SSMissionRequestSubject)
+
+	return nil
+}
+
+// ensureMissionConsumer 创建或更新 durable consumer，投递次数和 ack 超时以配置为准
+func ensureMissionConsumer(js ONats.JetStreamContext, config MissionConfig) error {
+	cc := &ONats.ConsumerConfig{
+		Durable:        config.Durable,
+		DeliverSubject: fmt.Sprintf("%s.Deliver", SSMissionRequestSubject),
+		DeliverGroup:   SSQueue,
+		FilterSubject:  SSMissionRequestSubject,
+		AckPolicy:      ONats.AckExplicitPolicy,
+		AckWait:        config.AckWait,
+		MaxDeliver:     config.MaxDeliver,
+	}
+
+	if _, err := js.ConsumerInfo(config.Stream, config.Durable); err == nil {
+		_, err = js.UpdateConsumer(config.Stream, cc)
+		return err
+	} else if !errors.Is(err, ONats.ErrConsumerNotFound) {
+		return err
+	}
+
+	if _, err := js.AddConsumer(config.Stream, cc); err != nil {
+		return err
+	}
+
+	logger.App().Infof("create consumer [%s] on stream [%s]", config.Durable, config.Stream)
+
+	return nil
+}
+
+// subscribeMaxDeliveries JetStream 模式下订阅超过投递次数的通知，把请求转到死信，多个实例只有一个处理
+func subscribeMaxDeliveries() (*ONats.Subscription, error) {
+	subject := fmt.Sprintf(missionMaxDeliveriesSubject, _mission.Stream, _mission.Durable)
+
+	return nats.Instance().QueueSubscribe(subject, SSQueue, doMaxDeliveries)
+}
+
+// ========================================================================================================
+
+// doStreamRequest 回复发出之后才 ack，实例中途退出时请求会重新投递给其他实例
+func doStreamRequest(msg *ONats.Msg) {
+	delivered := uint64(1)
+	if meta, err := msg.Metadata(); err == nil {
+		delivered = meta.NumDelivered
+	}
+
+	logger.App().Infof("=================================== request [%d] : %s", delivered, string(msg.Data))
+
+	if delivered > 1 {
+		addMissionStats(func(stats *MissionStats) { stats.Redelivery++ })
+	}
+
+	request := new(SSMRequestMsg)
+	if err := sonic.Unmarshal(msg.Data, request); err != nil {
+		logger.App().Errorf("unmarshal error : %s - %s", err.Error(), string(msg.Data))
+		deadLetter(msg, delivered, err.Error())
+		return
+	}
+
+	// 重新投递的请求之前已经做过置顶检查
+	// 这里的 msg.Reply 是 ack 主题，调用方的 inbox 只能放在 header 里，没有时回复照旧广播
+	request.reply = msg.Header.Get(MissionReplyHeader)
+
+	done := make(chan struct{})
+	if dispatch(request, delivered == 1, func() {
+		close(done)
+		ackMission(msg, request.TraceID)
+	}) {
+		go keepInProgress(msg, request.TraceID, done)
+		return
+	}
+
+	// 最后一次投递仍然处理不过来，告诉用户稍后再试
+	if delivered >= uint64(_mission.MaxDeliver) {
+		handleBusy(request)
+		deadLetter(msg, delivered, ErrBusy)
+		return
+	}
+
+	if err := msg.NakWithDelay(_mission.NakDelay); err != nil {
+		logger.App().Errorf("[%s] nak error : %s", request.TraceID, err.Error())
+		return
+	}
+
+	addMissionStats(func(stats *MissionStats) { stats.Naked++ })
+}
+
+// keepInProgress 在池里排队和执行期间定期延长 ack 超时，避免还没处理完就被重新投递
+func keepInProgress(msg *ONats.Msg, traceID string, done chan struct{}) {
+	ticker := time.NewTicker(_mission.AckWait / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := msg.InProgress(); err != nil {
+				logger.App().Errorf("[%s] in progress error : %s", traceID, err.Error())
+			}
+		}
+	}
+}
+
+func ackMission(msg *ONats.Msg, traceID string) {
+	if err := msg.Ack(); err != nil {
+		logger.App().Errorf("[%s] ack error : %s", traceID, err.Error())
+		return
+	}
+
+	addMissionStats(func(stats *MissionStats) { stats.Acked++ })
+}
+
+// doMaxDeliveries 超过投递次数的请求仍留在流里，取出来转到死信后删除
+func doMaxDeliveries(msg *ONats.Msg) {
+	advisory := struct {
+		Stream     string `json:"stream"`
+		StreamSeq  uint64 `json:"stream_seq"`
+		Deliveries uint64 `json:"deliveries"`
+	}{}
+	if err := sonic.Unmarshal(msg.Data, &advisory); err != nil {
+		logger.App().Errorf("unmarshal advisory error : %s - %s", err.Error(), string(msg.Data))
+		return
+	}
+
+	js, err := nats.Instance().JetStream()
+	if err != nil {
+		logger.App().Errorf("jetstream error : %s", err.Error())
+		return
+	}
+
+	raw, err := js.GetMsg(advisory.Stream, advisory.StreamSeq)
+	if err != nil {
+		logger.App().Errorf("get [%s][%d] error : %s", advisory.Stream, advisory.StreamSeq, err.Error())
+		return
+	}
+
+	publishDeadLetter(raw.Data, advisory.Deliveries, reasonMaxDeliveries)
+
+	if err = js.DeleteMsg(advisory.Stream, advisory.StreamSeq); err != nil {
+		logger.App().Errorf("delete [%s][%d] error : %s", advisory.Stream, advisory.StreamSeq, err.Error())
+	}
+}
+
+// deadLetter 转发到死信主题并终止投递
+func deadLetter(msg *ONats.Msg, delivered uint64, reason string) {
+	publishDeadLetter(msg.Data, delivered, reason)
+
+	if err := msg.Term(); err != nil {
+		logger.App().Errorf("term error : %s - %s", err.Error(), string(msg.Data))
+	}
+}
+
+// publishDeadLetter 原样转发，原因放在 header 里
+func publishDeadLetter(data []byte, delivered uint64, reason string) {
+	letter := ONats.NewMsg(_mission.DeadLetter)
+	letter.Data = data
+	letter.Header.Set("Search-Reason", reason)
+	letter.Header.Set("Search-Delivered", cast.ToString(delivered))
+
+	if err := nats.Instance().PublishMsg(letter); err != nil {
+		logger.App().Errorf("publish dead letter error : %s - %s", err.Error(), string(data))
+	}
+
+	logger.App().Warnf("dead letter [%s] after %d deliveries : %s", reason, delivered, string(data))
+
+	addMissionStats(func(stats *MissionStats) { stats.DeadLetter++ })
+}
+
+func addMissionStats(fn func(stats *MissionStats)) {
+	_missionMutex.Lock()
+	defer _missionMutex.Unlock()
+
+	fn(&_missionStats)
+}
+
+func missionStats() MissionStats {
+	_missionMutex.Lock()
+	defer _missionMutex.Unlock()
+
+	return _missionStats
+}
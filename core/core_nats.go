@@ -1,16 +1,14 @@
 package core
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"jarvis/dao/db/elasticsearch"
 	"jarvis/dao/db/mysql"
 	"jarvis/dao/db/redis"
 	"jarvis/logger"
 	"jarvis/middleware/mq/nats"
+	"search-service/core/search"
 	"strings"
 	"time"
 
@@ -74,221 +72,142 @@ var (
 	_subscriptions = make([]*ONats.Subscription, 0)
 )
 
-func checkAndPin() {
-	logger.App().Infoln("=================================================== start check and pin ===================================================")
-	defer logger.App().Infoln("=================================================== stop check and pin ===================================================")
+// checkAndPin 每次操作都计数，第一次和之后每 25 次发送一条置顶广告
+func checkAndPin(request SSMRequestMsg) {
+	if request.UserID == 0 {
+		return
+	}
 
-	for {
-		done := false
+	logger.App().Infof("=================== receive user id : %+v", request)
 
-		select {
-		case <-_close:
-			{
-				done = true
-			}
-		case request, ok := <-_check:
-			{
-				if !ok {
-					done = true
-					break
-				}
+	key := fmt.Sprintf("user:action:%d", request.UserID)
 
-				if request.UserID == 0 {
-					continue
+	if cmd := redis.Instance().IncrBy(context.Background(), key, 1); cmd.Err() != nil {
+		logger.App().Errorf("incr %s error : %s", key, cmd.Err().Error())
+		return
+	} else {
+		if (cmd.Val() == 1) || ((cmd.Val() % 25) == 0) {
+			logger.App().Infof("[%d] user action [%d] , send a pin", request.UserID, cmd.Val())
+
+			if title, link := GetTypeAd(request.Username, 2); title != "" && link != "" {
+				response := &SSMResponseMsg{
+					Type:    RTPin,
+					TraceID: request.TraceID, UserID: request.UserID, Username: request.Username, ChatID: request.ChatID, InMsgID: request.InMsgID, OutMsgID: request.OutMsgID,
+					Content:   title,
+					ParseMode: ParseModeText,
+					Markup:    generateMarkup([][][]string{{{"点击畅享", link, ""}}}),
 				}
-
-				logger.App().Infof("=================== receive user id : %+v", request)
-
-				key := fmt.Sprintf("user:action:%d", request.UserID)
-
-				if cmd := redis.Instance().IncrBy(context.Background(), key, 1); cmd.Err() != nil {
-					logger.App().Errorf("incr %s error : %s", key, cmd.Err().Error())
-					continue
-				} else {
-					if (cmd.Val() == 1) || ((cmd.Val() % 25) == 0) {
-						logger.App().Infof("[%d] user action [%d] , send a pin", request.UserID, cmd.Val())
-
-						if title, link := GetTypeAd(request.Username, 2); title != "" && link != "" {
-							response := &SSMResponseMsg{
-								Type:    RTPin,
-								TraceID: request.TraceID, UserID: request.UserID, Username: request.Username, ChatID: request.ChatID, InMsgID: request.InMsgID, OutMsgID: request.OutMsgID,
-								Content:   title,
-								ParseMode: ParseModeText,
-								Markup:    generateMarkup([][][]string{{{"点击畅享", link, ""}}}),
-							}
-							if err := doSendSSMResponse(response); err != nil {
-								logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
-								continue
-							}
-						}
-
-					}
+				if err := doSendSSMResponse(response); err != nil {
+					logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
+					return
 				}
 			}
-		}
 
-		if done {
-			break
 		}
 	}
 }
 
-func parseAndStore() {
-	logger.App().Infoln("=================================================== start do word analyze ===================================================")
-	defer logger.App().Infoln("=================================================== stop do word analyze ===================================================")
-
-	for {
-		done := false
-
-		select {
-		case <-_close:
-			{
-				done = true
-			}
-		case request, ok := <-_channel:
-			{
-				if !ok {
-					done = true
-					break
-				}
-
-				logger.App().Infof("=================== receive analyze : %+v", request)
-
-				if request.UserID != 0 {
-					now := time.Now()
-
-					isNew := false
-
-					inTotal := true
-					if cmd := redis.Instance().Get(context.Background(), fmt.Sprintf("UserID:%d", request.UserID)); cmd.Err() != nil {
-						if cmd.Err() != ORedis.Nil {
-							logger.App().Errorf("get [%s] error: %s", fmt.Sprintf("UserID:%d", request.UserID), cmd.Err().Error())
-						}
-						inTotal = false
-					}
-
-					if !inTotal {
-						isNew = true
-						if err := redis.Instance().Set(context.Background(), fmt.Sprintf("UserID:%d", request.UserID), 0, 0).Err(); err != nil {
-							logger.App().Errorf("set [%s] error: %s", fmt.Sprintf("UserID:%d", request.UserID), err.Error())
-						}
-						if err := redis.Instance().SAdd(context.Background(), fmt.Sprintf("%s:TodayNewUser:SET", now.Format("20060102")), request.UserID).Err(); err != nil {
-							logger.App().Errorf("sadd [%s] error: %s", fmt.Sprintf("UserID:%d", request.UserID), err.Error())
-						}
-					} else {
-						inToday := false
-						if cmd := redis.Instance().SIsMember(context.Background(), fmt.Sprintf("%s:TodayNewUser:SET", now.Format("20060102")), request.UserID); cmd.Err() != nil {
-							logger.App().Errorf("get [%s] error: %s", fmt.Sprintf("UserID:%d", request.UserID), cmd.Err().Error())
-						} else {
-							inToday = cmd.Val()
-						}
+// parseAndStore 统计用户和使用次数，记录搜索词的热度
+func parseAndStore(request SSMRequestMsg) {
+	logger.App().Infof("=================== receive analyze : %+v", request)
 
-						if inToday {
-							isNew = true
-						}
-					}
+	if request.UserID != 0 {
+		now := time.Now()
 
-					// total use
-					if cmd := redis.Instance().IncrBy(context.Background(), "TotalUse", 1); cmd.Err() != nil {
-						logger.App().Error("incr error : ", cmd.Err().Error())
-					}
-					// today use
-					if cmd := redis.Instance().IncrBy(context.Background(), fmt.Sprintf("%s:TodayUse", now.Format("20060102")), 1); cmd.Err() != nil {
-						logger.App().Error("incr error : ", cmd.Err().Error())
-					}
-					// hour use
-					if cmd := redis.Instance().IncrBy(context.Background(), fmt.Sprintf("%s:Use", now.Format("2006010215")), 1); cmd.Err() != nil {
-						logger.App().Error("incr error : ", cmd.Err().Error())
-					}
-					// total user
-					if cmd := redis.Instance().PFAdd(context.Background(), "TotalUser", request.UserID); cmd.Err() != nil {
-						logger.App().Error("pfadd error : ", cmd.Err().Error())
-					}
-					// today user
-					if cmd := redis.Instance().PFAdd(context.Background(), fmt.Sprintf("%s:TodayUser", now.Format("20060102")), request.UserID); cmd.Err() != nil {
-						logger.App().Error("pfadd error : ", cmd.Err().Error())
-					}
-					if isNew {
-						// today new user use
-						if cmd := redis.Instance().IncrBy(context.Background(), fmt.Sprintf("%s:TodayNewUserUse", now.Format("20060102")), 1); cmd.Err() != nil {
-							logger.App().Error("incr error : ", cmd.Err().Error())
-						}
-						// today new user
-						if cmd := redis.Instance().PFAdd(context.Background(), fmt.Sprintf("%s:TodayNewUser", now.Format("20060102")), request.UserID); cmd.Err() != nil {
-							logger.App().Error("pfadd error : ", cmd.Err().Error())
-						}
-					}
-				}
+		isNew := false
 
-				// 构建分析请求体
-				reqBody := map[string]any{"analyzer": "ik_smart", "text": request.Content}
+		inTotal := true
+		if cmd := redis.Instance().Get(context.Background(), fmt.Sprintf("UserID:%d", request.UserID)); cmd.Err() != nil {
+			if cmd.Err() != ORedis.Nil {
+				logger.App().Errorf("get [%s] error: %s", fmt.Sprintf("UserID:%d", request.UserID), cmd.Err().Error())
+			}
+			inTotal = false
+		}
 
-				// 编码成 JSON
-				body, err := json.Marshal(reqBody)
-				if err != nil {
-					logger.App().Errorf("Error encoding request: %s", err.Error())
-					continue
-				}
+		if !inTotal {
+			isNew = true
+			if err := redis.Instance().Set(context.Background(), fmt.Sprintf("UserID:%d", request.UserID), 0, 0).Err(); err != nil {
+				logger.App().Errorf("set [%s] error: %s", fmt.Sprintf("UserID:%d", request.UserID), err.Error())
+			}
+			if err := redis.Instance().SAdd(context.Background(), fmt.Sprintf("%s:TodayNewUser:SET", now.Format("20060102")), request.UserID).Err(); err != nil {
+				logger.App().Errorf("sadd [%s] error: %s", fmt.Sprintf("UserID:%d", request.UserID), err.Error())
+			}
+		} else {
+			inToday := false
+			if cmd := redis.Instance().SIsMember(context.Background(), fmt.Sprintf("%s:TodayNewUser:SET", now.Format("20060102")), request.UserID); cmd.Err() != nil {
+				logger.App().Errorf("get [%s] error: %s", fmt.Sprintf("UserID:%d", request.UserID), cmd.Err().Error())
+			} else {
+				inToday = cmd.Val()
+			}
 
-				// 执行请求
-				res, err := elasticsearch.Instance().Indices.Analyze(
-					elasticsearch.Instance().Indices.Analyze.WithBody(bytes.NewReader(body)),
-					elasticsearch.Instance().Indices.Analyze.WithContext(context.Background()),
-				)
-				if err != nil {
-					logger.App().Errorf("Analyze request failed: %s", err.Error())
-					continue
-				}
-				defer res.Body.Close()
+			if inToday {
+				isNew = true
+			}
+		}
 
-				// 检查状态
-				if res.IsError() {
-					logger.App().Errorf("Error analyzing text: %s", res.String())
-				}
+		// total use
+		if cmd := redis.Instance().IncrBy(context.Background(), "TotalUse", 1); cmd.Err() != nil {
+			logger.App().Error("incr error : ", cmd.Err().Error())
+		}
+		// today use
+		if cmd := redis.Instance().IncrBy(context.Background(), fmt.Sprintf("%s:TodayUse", now.Format("20060102")), 1); cmd.Err() != nil {
+			logger.App().Error("incr error : ", cmd.Err().Error())
+		}
+		// hour use
+		if cmd := redis.Instance().IncrBy(context.Background(), fmt.Sprintf("%s:Use", now.Format("2006010215")), 1); cmd.Err() != nil {
+			logger.App().Error("incr error : ", cmd.Err().Error())
+		}
+		// total user
+		if cmd := redis.Instance().PFAdd(context.Background(), "TotalUser", request.UserID); cmd.Err() != nil {
+			logger.App().Error("pfadd error : ", cmd.Err().Error())
+		}
+		// today user
+		if cmd := redis.Instance().PFAdd(context.Background(), fmt.Sprintf("%s:TodayUser", now.Format("20060102")), request.UserID); cmd.Err() != nil {
+			logger.App().Error("pfadd error : ", cmd.Err().Error())
+		}
+		if isNew {
+			// today new user use
+			if cmd := redis.Instance().IncrBy(context.Background(), fmt.Sprintf("%s:TodayNewUserUse", now.Format("20060102")), 1); cmd.Err() != nil {
+				logger.App().Error("incr error : ", cmd.Err().Error())
+			}
+			// today new user
+			if cmd := redis.Instance().PFAdd(context.Background(), fmt.Sprintf("%s:TodayNewUser", now.Format("20060102")), request.UserID); cmd.Err() != nil {
+				logger.App().Error("pfadd error : ", cmd.Err().Error())
+			}
+		}
+	}
 
-				// 解析响应
-				var result struct {
-					Tokens []struct {
-						Token string `json:"token"`
-					} `json:"tokens"`
-				}
-				if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
-					logger.App().Errorf("Error parsing response: %s", err.Error())
-					continue
-				}
+	tokens, err := search.Analyze(request.Content)
+	if err != nil {
+		logger.App().Errorf("Analyze request failed: %s", err.Error())
+		return
+	}
 
-				m := make(map[string]struct{})
-				for _, t := range result.Tokens {
-					if len([]rune(t.Token)) < 2 {
-						continue
-					}
+	m := make(map[string]struct{})
+	for _, token := range tokens {
+		if len([]rune(token)) < 2 {
+			continue
+		}
 
-					m[t.Token] = struct{}{}
-				}
+		m[token] = struct{}{}
+	}
 
-				for token := range m {
-					if err := redis.Instance().ZIncrBy(context.Background(), "HotRankList", 1.0, token).Err(); err != nil {
-						logger.App().Error("zincrby %s error : %s", token, err.Error())
-					}
-					if err := redis.Instance().HIncrBy(context.Background(), "SearchHash", token, 1).Err(); err != nil {
-						logger.App().Error("hincrby %s error : %s", token, err.Error())
-					}
-					if err := mysql.Instance().Table("search_log").Create(&struct {
-						ID      uint   `gorm:"column:id;not null;autoIncrement:false;primaryKey;comment:主键ID" json:"id"`
-						Created int64  `gorm:"column:created;not null;index:idx_create_time;index:idx_word_create_time,priority:2;comment:时间戳(毫秒);primaryKey" json:"created"`
-						Word    string `gorm:"column:word;type:varchar(255);not null;index:idx_word_create_time,priority:1;comment:搜索词" json:"word"`
-					}{
-						Created: time.Now().UnixMilli(),
-						Word:    token,
-					}).Error; err != nil {
-						logger.App().Error("insert %s error : %s", token, err.Error())
-					}
-				}
-			}
+	for token := range m {
+		if err := redis.Instance().ZIncrBy(context.Background(), "HotRankList", 1.0, token).Err(); err != nil {
+			logger.App().Error("zincrby %s error : %s", token, err.Error())
 		}
-
-		if done {
-			break
+		if err := redis.Instance().HIncrBy(context.Background(), "SearchHash", token, 1).Err(); err != nil {
+			logger.App().Error("hincrby %s error : %s", token, err.Error())
+		}
+		if err := mysql.Instance().Table("search_log").Create(&struct {
+			ID      uint   `gorm:"column:id;not null;autoIncrement:false;primaryKey;comment:主键ID" json:"id"`
+			Created int64  `gorm:"column:created;not null;index:idx_create_time;index:idx_word_create_time,priority:2;comment:时间戳(毫秒);primaryKey" json:"created"`
+			Word    string `gorm:"column:word;type:varchar(255);not null;index:idx_word_create_time,priority:1;comment:搜索词" json:"word"`
+		}{
+			Created: time.Now().UnixMilli(),
+			Word:    token,
+		}).Error; err != nil {
+			logger.App().Error("insert %s error : %s", token, err.Error())
 		}
 	}
 }
@@ -336,6 +255,10 @@ return true
 						logger.App().Errorf("decay error : %s", err.Error())
 					}
 
+					if err := loadVocabulary(); err != nil {
+						logger.App().Errorf("load vocabulary error : %s", err.Error())
+					}
+
 					yesterday := t.Add(time.Hour * time.Duration(-24))
 					keys := []string{
 						fmt.Sprintf("%s:Use", yesterday.Format("2006010215")),            // hour use
@@ -450,6 +373,18 @@ func doCache(msg *ONats.Msg) {
 				logger.App().Errorf("load keyword ad error : %s", err.Error())
 			}
 		}
+	case CacheBlocklist:
+		{
+			if err := loadBlocklist(); err != nil {
+				logger.App().Errorf("load blocklist error : %s", err.Error())
+			}
+		}
+	case CacheSynonym:
+		{
+			if err := loadSynonyms(); err != nil {
+				logger.App().Errorf("load synonyms error : %s", err.Error())
+			}
+		}
 	}
 }
 
@@ -497,12 +432,25 @@ const (
 	RTPin                           // send a new message then pin it
 	RTDelete                        // delete that message
 	RTVideo                         // send a new message with video
+	RTInline                        // answer an inline query with Results
+)
+
+// ErrBusy 请求被丢弃时 SSMResponseMsg.Error 的值
+const ErrBusy = "busy"
+
+type SSMRequestKind uint16
+
+const (
+	RKMessage SSMRequestKind = iota // message or callback in a chat
+	RKInline                        // inline query, @bot keyword in any chat
 )
 
 const (
 	SSQueue                  = "SearchQueue"
 	SSMissionRequestSubject  = "Search.Mission.Request"
 	SSMissionResponseSubject = "Search.Mission.Response"
+
+	SSMissionDeadLetterSubject = "Search.Mission.DeadLetter"
 )
 
 type SSMRequestMsg struct {
@@ -515,6 +463,13 @@ type SSMRequestMsg struct {
 	OutMsgID int    `json:"out_msg_id"`
 	Behavior string `json:"behavior"`
 	Content  string `json:"content"`
+	Language string `json:"language"` // language_code of the user, such as en, ru, zh-hans
+
+	Kind          SSMRequestKind `json:"kind"`
+	InlineQueryID string         `json:"inline_query_id"` // RKInline
+	Offset        string         `json:"offset"`          // RKInline, next_offset of the last answer
+
+	reply string // 调用方的 inbox，主回复发到这里，为空时广播
 }
 
 type SSMResponseMsg struct {
@@ -530,6 +485,10 @@ type SSMResponseMsg struct {
 	Markup      map[string]any  `json:"markup"`
 	VideoFileID string          `json:"video_file_id"`
 	Error       string          `json:"error"`
+
+	InlineQueryID string         `json:"inline_query_id,omitempty"` // RTInline
+	Results       []InlineResult `json:"results,omitempty"`         // RTInline
+	NextOffset    string         `json:"next_offset,omitempty"`     // RTInline, empty means no more results
 }
 
 func doRequest(msg *ONats.Msg) {
@@ -542,19 +501,67 @@ func doRequest(msg *ONats.Msg) {
 		return
 	}
 
-	// any behavior touch the pin check
-	go func() { _check <- *(request) }()
+	// 调用方用 request 发送时主回复发到它的 inbox，其他回复照旧广播到 Search.Mission.Response
+	request.reply = msg.Reply
+
+	if !dispatch(request, true, func() {}) {
+		handleBusy(request)
+	}
+}
+
+// dispatch 按请求类别提交到对应的池，handler 返回后调用 done，池满时返回 false
+// check 为 false 时不做置顶检查，用于重新投递的请求
+func dispatch(request *SSMRequestMsg, check bool, done func()) bool {
+	// inline 每输入一个字都会来一次，不参与置顶检查和统计
+	if request.Kind == RKInline {
+		return submit(PoolSearch, request.TraceID, func() {
+			handleInline(request)
+			done()
+		})
+	}
+
+	// any behavior touch the pin check，统计满了直接丢弃，不影响用户
+	if check {
+		copied := *(request)
+		submit(PoolAnalytics, request.TraceID, func() { checkAndPin(copied) })
+	}
 
 	standard := request.Behavior
 	if request.Behavior == "" {
 		standard = request.Content
 	}
 
-	handler, exist := _behaviorMap[standard]
-	if exist {
-		go handler(request)
+	pool, handler := PoolMenu, handleOther
+	if h, exist := _behaviorMap[standard]; exist {
+		handler = h
 	} else {
-		go handleOther(request)
+		pool = PoolSearch
+	}
+
+	return submit(pool, request.TraceID, func() {
+		handler(request)
+		done()
+	})
+}
+
+// handleBusy 处理不过来时直接告诉用户稍后再试，不再排队
+func handleBusy(request *SSMRequestMsg) {
+	response := &SSMResponseMsg{
+		Type:    RTSend,
+		TraceID: request.TraceID, UserID: request.UserID, Username: request.Username, ChatID: request.ChatID, InMsgID: request.InMsgID, OutMsgID: request.OutMsgID,
+		Content:   "⏳当前搜索的人太多了，请稍后再试",
+		ParseMode: ParseModeText,
+		Markup:    map[string]any{},
+		Error:     ErrBusy,
+	}
+
+	if request.Kind == RKInline {
+		response.Type, response.Content, response.ParseMode = RTInline, "", ""
+		response.InlineQueryID, response.Results = request.InlineQueryID, []InlineResult{}
+	}
+
+	if err := doReplySSMResponse(request, response); err != nil {
+		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
 
@@ -573,6 +580,27 @@ func doSendSSMResponse(response *SSMResponseMsg) error {
 	return nats.Instance().Publish(SSMissionResponseSubject, data)
 }
 
+// doReplySSMResponse 发送 handler 的主回复，调用方用 request 发送时回到它的 inbox，否则和 doSendSSMResponse 一样广播
+// 置顶广告、开始视频等附带的回复仍然用 doSendSSMResponse 广播
+func doReplySSMResponse(request *SSMRequestMsg, response *SSMResponseMsg) error {
+	if request.reply == "" {
+		return doSendSSMResponse(response)
+	}
+
+	if response == nil {
+		return errors.New("response is nil")
+	}
+
+	data, err := sonic.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	logger.App().Infof("=================================== reply [%s] : %s", request.reply, string(data))
+
+	return nats.Instance().Publish(request.reply, data)
+}
+
 func handleStart(request *SSMRequestMsg) {
 	if fileID, exist := _videoFileIDMap[VideoStart]; exist {
 		extraResponse := &SSMResponseMsg{
@@ -609,7 +637,7 @@ func handleStart(request *SSMRequestMsg) {
 		response.Markup = markup
 	}
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -632,7 +660,7 @@ func handleReso(request *SSMRequestMsg) {
 		response.Markup = markup
 	}
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -655,7 +683,7 @@ func handleDaoh(request *SSMRequestMsg) {
 		response.Markup = markup
 	}
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -682,7 +710,7 @@ func handleHelp(request *SSMRequestMsg) {
 		response.Markup = markup
 	}
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -709,7 +737,7 @@ func handleMore(request *SSMRequestMsg) {
 		response.Markup = markup
 	}
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -732,7 +760,7 @@ func handlePrivacy(request *SSMRequestMsg) {
 		response.Markup = markup
 	}
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -760,9 +788,10 @@ func handleOther(request *SSMRequestMsg) {
 	}
 
 	// only do analyze when send a search
-	go func() { _channel <- *(request) }()
+	analyze := *(request)
+	submit(PoolAnalytics, request.TraceID, func() { parseAndStore(analyze) })
 
-	if content, parseMode, markup, err := other(request.UserID, request.InMsgID, request.Username, request.Behavior, request.Content); err != nil {
+	if content, parseMode, markup, err := other(request.UserID, request.InMsgID, request.Username, request.Language, request.Behavior, request.Content); err != nil {
 		response.Error = err.Error()
 		logger.App().Errorf("[%s] parse error : %s", response.TraceID, err.Error())
 	} else {
@@ -771,7 +800,7 @@ func handleOther(request *SSMRequestMsg) {
 		response.Markup = markup
 	}
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -796,7 +825,7 @@ func handleDaohAnother(request *SSMRequestMsg) {
 		response.Markup = markup
 	}
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -821,7 +850,7 @@ func handleDaohBack(request *SSMRequestMsg) {
 		response.Markup = markup
 	}
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -839,7 +868,7 @@ func handleHelpR18(request *SSMRequestMsg) {
 
 	response.Content, response.ParseMode, response.Markup, response.VideoFileID = behaviorRelease18()
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -857,7 +886,7 @@ func handleHelpFM(request *SSMRequestMsg) {
 
 	response.Content, response.ParseMode, response.Markup, response.VideoFileID = behaviorFreeMusic()
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -875,7 +904,7 @@ func handleHelpCL(request *SSMRequestMsg) {
 
 	response.Content, response.ParseMode, response.Markup, response.VideoFileID = behaviorChangeLanuage()
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -893,7 +922,7 @@ func handleHelpDS(request *SSMRequestMsg) {
 
 	response.Content, response.ParseMode, response.Markup = behaviorDefendScam()
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -911,7 +940,7 @@ func handleHelpRMG(request *SSMRequestMsg) {
 
 	response.Content, response.ParseMode, response.Markup = behaviorRecordMyGroup()
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -929,7 +958,7 @@ func handleHelpBG(request *SSMRequestMsg) {
 
 	response.Content, response.ParseMode, response.Markup, response.VideoFileID = behaviorBuildGroup()
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -947,7 +976,7 @@ func handleHelpProfit(request *SSMRequestMsg) {
 
 	response.Content, response.ParseMode, response.Markup = behaviorProfit()
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -965,7 +994,7 @@ func handleHelpAD(request *SSMRequestMsg) {
 
 	response.Content, response.ParseMode, response.Markup = behaviorAD()
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -983,7 +1012,7 @@ func handleHelpReport(request *SSMRequestMsg) {
 
 	response.Content, response.ParseMode, response.Markup = behaviorReport()
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -1001,7 +1030,7 @@ func handleMoreShowQuery(request *SSMRequestMsg) {
 
 	response.Content, response.ParseMode, response.Markup = behaviorShowQuery()
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -1018,8 +1047,40 @@ func handleMoreR18(request *SSMRequestMsg) {
 	response.Type = RTVideo
 
 	response.Content, response.ParseMode, response.Markup, response.VideoFileID = behaviorRelease18()
+	response.Markup = generateSafeSearchMarkup(request.UserID)
+
+	if err := doReplySSMResponse(request, response); err != nil {
+		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
+	}
+}
+
+func handleMoreR18On(request *SSMRequestMsg) {
+	handleSafeSearch(request, false)
+}
+
+func handleMoreR18Off(request *SSMRequestMsg) {
+	handleSafeSearch(request, true)
+}
+
+func handleSafeSearch(request *SSMRequestMsg, on bool) {
+	response := &SSMResponseMsg{
+		Type:    RTSend,
+		TraceID: request.TraceID, UserID: request.UserID, Username: request.Username, ChatID: request.ChatID, InMsgID: request.InMsgID, OutMsgID: request.OutMsgID,
+		Content:   "",
+		ParseMode: "",
+		Markup:    map[string]any{},
+	}
+
+	if content, parseMode, markup, err := behaviorSafeSearch(request.UserID, on); err != nil {
+		response.Error = err.Error()
+		logger.App().Errorf("[%s] parse error : %s", response.TraceID, err.Error())
+	} else {
+		response.Content = content
+		response.ParseMode = parseMode
+		response.Markup = markup
+	}
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -1037,7 +1098,7 @@ func handleMoreRML(request *SSMRequestMsg) {
 
 	response.Content, response.ParseMode, response.Markup = behaviorRecordMyLink()
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -1057,7 +1118,7 @@ func handleMoreIMM(request *SSMRequestMsg) {
 
 	response.Content, response.ParseMode, response.Markup = behaviorInviteMakeMoney(request.UserID, request.FLName)
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -1077,7 +1138,7 @@ func handleMorePAD(request *SSMRequestMsg) {
 
 	response.Content, response.ParseMode, response.Markup = behaviorPutAD()
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -1093,7 +1154,7 @@ func handleMorePT(request *SSMRequestMsg) {
 
 	response.Content, response.ParseMode, response.Markup = behaviorPT(request.UserID)
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -1109,7 +1170,7 @@ func handleMoreCQ(request *SSMRequestMsg) {
 
 	response.Content, response.ParseMode, response.Markup = behaviorCQ()
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -1125,7 +1186,7 @@ func handlePrivacyClose(request *SSMRequestMsg) {
 
 	response.Type = RTDelete
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -1141,7 +1202,7 @@ func handleMorePADKW(request *SSMRequestMsg) {
 
 	response.Content, response.ParseMode, response.Markup = behaviorPADKW()
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -1157,7 +1218,7 @@ func handleMorePADTL(request *SSMRequestMsg) {
 
 	response.Content, response.ParseMode, response.Markup = behaviorPADTL()
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -1173,7 +1234,7 @@ func handleMorePADBL(request *SSMRequestMsg) {
 
 	response.Content, response.ParseMode, response.Markup = behaviorPADBL()
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -1189,7 +1250,7 @@ func handleMorePADGP(request *SSMRequestMsg) {
 
 	response.Content, response.ParseMode, response.Markup = behaviorPADGP()
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -1205,7 +1266,7 @@ func handleMorePADBAD(request *SSMRequestMsg) {
 
 	response.Content, response.ParseMode, response.Markup = behaviorPADBAD()
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -1221,7 +1282,7 @@ func handleMorePADHPAD(request *SSMRequestMsg) {
 
 	response.Content, response.ParseMode, response.Markup = behaviorPADHPAD()
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -1237,7 +1298,7 @@ func handleMorePADMAD(request *SSMRequestMsg) {
 
 	response.Content, response.ParseMode, response.Markup = behaviorPADMAD(request.UserID, request.Username, request.FLName)
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -1253,7 +1314,7 @@ func handleMoreIMMPF(request *SSMRequestMsg) {
 
 	response.Content, response.ParseMode, response.Markup = behaviorIMMPF()
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -1269,7 +1330,7 @@ func handleMoreIMMPCO(request *SSMRequestMsg) {
 
 	response.Content, response.ParseMode, response.Markup = behaviorIMMPCO()
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -1285,7 +1346,7 @@ func handleMoreIMMGNR(request *SSMRequestMsg) {
 
 	response.Content, response.ParseMode, response.Markup = behaviorIMMGNR()
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -1301,7 +1362,7 @@ func handleMoreIMMPR(request *SSMRequestMsg) {
 
 	response.Content, response.ParseMode, response.Markup = behaviorIMMPR()
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -1317,7 +1378,7 @@ func handleMoreIMMBA(request *SSMRequestMsg) {
 
 	response.Content, response.ParseMode, response.Markup = behaviorIMMBA()
 
-	if err := doSendSSMResponse(response); err != nil {
+	if err := doReplySSMResponse(request, response); err != nil {
 		logger.App().Errorf("do send SSMResponseMsg error : %s - %+v", err.Error(), *(response))
 	}
 }
@@ -2,15 +2,17 @@ package core
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"jarvis/dao/db/redis"
 	"jarvis/logger"
 	"search-service/core/search"
-	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/bytedance/sonic"
+	ORedis "github.com/redis/go-redis/v9"
 	"github.com/spf13/cast"
 )
 
@@ -73,6 +75,9 @@ const (
 	BehaviorDataBot     = "_BOT_"
 	BehaviorDataLast    = "_LAST_"
 	BehaviorDataNext    = "_NEXT_"
+	BehaviorDataProfile = "_PROFILE_:" // 后面接排序方式的名字
+	BehaviorDataDYM     = "_DYM_:"     // 后面接纠错后的输入
+	BehaviorDataPeriod  = "_PERIOD_:"  // 后面接时间范围
 
 	BehaviorClose = "_CLOSE_"
 
@@ -80,6 +85,8 @@ const (
 	BehaviorAnother = "_ANOTHER_"
 
 	BehaviorR18    = "_R18_"
+	BehaviorOn     = "_ON_"
+	BehaviorOff    = "_OFF_"
 	BehaviorFM     = "_RM_"
 	BehaviorCL     = "_CL_"
 	BehaviorDS     = "_DS_"
@@ -159,6 +166,8 @@ var _behaviorMap = map[string]func(*SSMRequestMsg){
 	strings.Join([]string{OrderHelp, BehaviorReport}, "."):           handleHelpReport,
 	strings.Join([]string{OrderMore, BehaviorShowQuery}, "."):        handleMoreShowQuery,
 	strings.Join([]string{OrderMore, BehaviorR18}, "."):              handleMoreR18,
+	strings.Join([]string{OrderMore, BehaviorR18, BehaviorOn}, "."):  handleMoreR18On,
+	strings.Join([]string{OrderMore, BehaviorR18, BehaviorOff}, "."): handleMoreR18Off,
 	strings.Join([]string{OrderMore, BehaviorRML}, "."):              handleMoreRML,
 	strings.Join([]string{OrderMore, BehaviorIMM}, "."):              handleMoreIMM,
 	strings.Join([]string{OrderMore, BehaviorPAD}, "."):              handleMorePAD,
@@ -298,49 +307,126 @@ If you have any questions or concerns about this Privacy Policy, If you have any
 	return text, ParseModeMarkdownV2, generateMarkup([][][]string{{{"X关闭", "", strings.Join([]string{OrderPrivacy, BehaviorClose}, ".")}}}), nil
 }
 
-func other(userID, messageID int, username, behavior, text string) (string, string, map[string]any, error) {
-	st := uint8(0)
-	sorts := []float64{}
+// searchState 每条搜索结果消息的搜索类型和排序方式
+type searchState struct {
+	Type    uint8  `json:"type"`
+	Profile string `json:"profile"`
+	Text    string `json:"text,omitempty"`   // 点了纠错建议之后实际搜索的内容
+	Period  string `json:"period,omitempty"` // 发布时间范围，见 Period*
+}
+
+const (
+	PeriodAll   = ""
+	PeriodToday = "today"
+	PeriodWeek  = "week"
+	PeriodMonth = "month"
+)
+
+var _periods = [][]string{
+	{"今天", PeriodToday},
+	{"本周", PeriodWeek},
+	{"本月", PeriodMonth},
+	{"全部", PeriodAll},
+}
+
+// periodRange 按服务所在时区计算时间范围的起点，毫秒，全部时返回 0
+func periodRange(period string, now time.Time) int64 {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	switch period {
+	case PeriodToday:
+		return today.UnixMilli()
+	case PeriodWeek:
+		// 周一是一周的第一天
+		return today.AddDate(0, 0, -(int(today.Weekday())+6)%7).UnixMilli()
+	case PeriodMonth:
+		return today.AddDate(0, 0, 1-today.Day()).UnixMilli()
+	}
+
+	return 0
+}
+
+// parseSearchState 兼容旧版本只保存了搜索类型数字的值
+func parseSearchState(value any) searchState {
+	state := searchState{}
+	if value == nil {
+		return state
+	}
+
+	data := cast.ToString(value)
+	if err := sonic.UnmarshalString(data, &state); err != nil {
+		state.Type = cast.ToUint8(data)
+	}
+
+	return state
+}
+
+func getSearchState(userID, messageID int) searchState {
+	tKey := fmt.Sprintf("SearchType:%d:%d", userID, messageID)
+
+	value, err := redis.Instance().Get(context.Background(), tKey).Result()
+	if err != nil {
+		if err != ORedis.Nil {
+			logger.App().Errorf("get %s error : %s", tKey, err.Error())
+		}
+		return searchState{}
+	}
+
+	return parseSearchState(value)
+}
+
+func other(userID, messageID int, username, language, behavior, text string) (string, string, map[string]any, error) {
+	state := searchState{}
+	sorts := []any{}
 	coverSort := true
 
+	// 点击按钮时沿用这条消息当前的搜索类型和排序方式
+	if behavior != "" {
+		state = getSearchState(userID, messageID)
+	}
+
 	switch behavior {
+	case BehaviorDataAll:
+		{
+			state.Type = 0
+		}
 	case BehaviorDataGroup:
 		{
-			st = 1
+			state.Type = 1
 		}
 	case BehaviorDataChannel:
 		{
-			st = 2
+			state.Type = 2
 		}
 	case BehaviorDataVideo:
 		{
-			st = 3
+			state.Type = 3
 		}
 	case BehaviorDataPhoto:
 		{
-			st = 4
+			state.Type = 4
 		}
 	case BehaviorDataVoice:
 		{
-			st = 5
+			state.Type = 5
 		}
 	case BehaviorDataText:
 		{
-			st = 6
+			state.Type = 6
 		}
 	case BehaviorDataFile:
 		{
-			st = 7
+			state.Type = 7
 		}
 	case BehaviorDataBot:
 		{
-			st = 8
+			state.Type = 8
 		}
 	case BehaviorDataLast:
 		{
 			coverSort = false
 			var err error
-			if sorts, st, err = getSortsAndSearchType(true, userID, messageID); err != nil {
+			if sorts, state, err = getSortsAndSearchType(true, userID, messageID); err != nil {
 				return "", "", map[string]any{}, err
 			}
 		}
@@ -348,10 +434,34 @@ func other(userID, messageID int, username, behavior, text string) (string, stri
 		{
 			coverSort = false
 			var err error
-			if sorts, st, err = getSortsAndSearchType(false, userID, messageID); err != nil {
+			if sorts, state, err = getSortsAndSearchType(false, userID, messageID); err != nil {
 				return "", "", map[string]any{}, err
 			}
 		}
+	default:
+		{
+			// 切换排序方式，翻页游标从头开始
+			if name, ok := strings.CutPrefix(behavior, BehaviorDataProfile); ok {
+				state.Profile = name
+			}
+			// 按纠错后的内容重新搜索
+			if corrected, ok := strings.CutPrefix(behavior, BehaviorDataDYM); ok {
+				state.Text = corrected
+			}
+			// 切换时间范围，和切换排序方式一样从第一页开始
+			if period, ok := strings.CutPrefix(behavior, BehaviorDataPeriod); ok {
+				state.Period = period
+			}
+		}
+	}
+
+	if state.Text != "" {
+		text = state.Text
+	}
+
+	// 配置里已经去掉的排序方式退回默认
+	if _, exist := search.Profile(state.Profile); !exist {
+		state.Profile = ""
 	}
 
 	if coverSort {
@@ -360,15 +470,28 @@ func other(userID, messageID int, username, behavior, text string) (string, stri
 		}
 	}
 
-	logger.App().Infof("do search by condition : [%d] [%s] %+v", st, text, sorts)
+	logger.App().Infof("do search by condition : [%d] [%s] [%s] %+v", state.Type, text, state.Profile, sorts)
 
-	result, err := search.Search(st, text, sorts)
+	result, err := search.Search(state.Type, text, sorts, search.Options{
+		NSFW:       !getSafeSearch(userID),
+		Profile:    state.Profile,
+		Language:   language,
+		PostedFrom: periodRange(state.Period, time.Now()),
+	})
 	if err != nil {
+		// 操作符写错了告诉用户，不当成关键词去搜
+		if oe := new(search.OperatorError); errors.As(err, &oe) {
+			return behaviorUnknownOperator(oe.Operators)
+		}
 		return "", "", map[string]any{}, err
 	}
 
 	logger.App().Errorf("do search success : %+v", *(result))
 
+	if result.Degraded {
+		logger.App().Warnf("do search degraded : [%d] [%s]", state.Type, text)
+	}
+
 	value := ""
 	if title, link := GetTypeAd(username, 5); title != "" && link != "" {
 		value = fmt.Sprintf("广告:[%s](%s)\n\n", EscapeMarkdownV2(title), link)
@@ -391,23 +514,36 @@ func other(userID, messageID int, username, behavior, text string) (string, stri
 		value += fmt.Sprintf("%2d\\.[%s](%s)\n", idx+1, EscapeMarkdownV2(item.Content), item.Link)
 	}
 
-	params := [][][]string{
-		generateSearchType(st),
-		generateLastNextPage(result.Next, username, userID, messageID),
+	if len(result.Content) == 0 {
+		value += "没有找到相关结果\n"
+	}
+
+	params := generateDidYouMean(result.Suggestions)
+
+	params = append(params, generateSearchType(result.Type))
+
+	// 排序方式和时间范围只对消息有效
+	if result.Profile != "" {
+		params = append(params, generateProfile(result.Profile), generatePeriod(state.Period))
 	}
 
+	params = append(params, generateLastNextPage(result.Next, username, userID, messageID))
+
 	if title, link := GetTypeAd(username, 3); title != "" && link != "" {
 		params = append(params, [][]string{{title, link, ""}})
 	}
 
-	go saveSortsAndSearchType(userID, messageID, result.LastSort[:], st)
+	go saveSortsAndSearchType(userID, messageID, result.LastSort[:], state)
 
 	return value, ParseModeMarkdownV2, generateMarkup(params), nil
 }
 
 func generateSearchType(st uint8) [][]string {
 	origin := []uint8{0, 1, 2, 3, 4, 5, 6, 7, 8}
-	origin = append(origin[:int(st)], origin[int(st+1):]...)
+	// type:media 没有对应的按钮
+	if int(st) < len(origin) {
+		origin = append(origin[:int(st)], origin[int(st+1):]...)
+	}
 
 	left := make([][]string, 0)
 
@@ -419,6 +555,61 @@ func generateSearchType(st uint8) [][]string {
 	return left
 }
 
+func behaviorUnknownOperator(operators []string) (string, string, map[string]any, error) {
+	text := fmt.Sprintf(`无法识别或当前类型不支持的搜索条件：*%s*
+
+支持的条件：
+• type:video 类型 all/group/channel/video/photo/voice/text/file/bot/media
+• link:@channel 只搜这个频道或群组
+• min\_members:1000 群组/频道的最少成员数
+• min\_messages:100 群组/频道的最少消息数`, EscapeMarkdownV2(strings.Join(operators, " ")))
+
+	return text, ParseModeMarkdownV2, map[string]any{}, nil
+}
+
+// generateDidYouMean 每个纠错建议一行，callback_data 超过 64 字节的放不下
+func generateDidYouMean(suggestions []string) [][][]string {
+	params := make([][][]string, 0)
+
+	for _, suggestion := range suggestions {
+		data := BehaviorDataDYM + suggestion
+		if len(data) > 64 {
+			continue
+		}
+		params = append(params, [][]string{{"你是不是要找：" + suggestion, "", data}})
+	}
+
+	return params
+}
+
+// generatePeriod 切换时间范围的按钮，不包含当前的
+func generatePeriod(current string) [][]string {
+	params := make([][]string, 0)
+
+	for _, period := range _periods {
+		if period[1] == current {
+			continue
+		}
+		params = append(params, []string{period[0], "", BehaviorDataPeriod + period[1]})
+	}
+
+	return params
+}
+
+// generateProfile 切换排序方式的按钮，不包含当前的
+func generateProfile(current string) [][]string {
+	params := make([][]string, 0)
+
+	for _, profile := range search.Profiles() {
+		if profile.Name == current {
+			continue
+		}
+		params = append(params, []string{profile.Label, "", BehaviorDataProfile + profile.Name})
+	}
+
+	return params
+}
+
 func generateLastNextPage(next bool, username string, userID, messageID int) [][]string {
 	sKey := fmt.Sprintf("Sorts:%d:%d", userID, messageID)
 
@@ -477,7 +668,32 @@ func generateMarkup(params [][][]string) map[string]any {
 	return map[string]any{"inline_keyboard": buttons}
 }
 
-func getSortsAndSearchType(pop bool, userID, messageID int) ([]float64, uint8, error) {
+// getSafeSearch 默认开启安全搜索，只有用户主动关闭时才返回 false
+func getSafeSearch(userID int) bool {
+	key := fmt.Sprintf("SafeSearch:%d", userID)
+
+	value, err := redis.Instance().Get(context.Background(), key).Result()
+	if err != nil {
+		if err != ORedis.Nil {
+			logger.App().Errorf("get %s error : %s", key, err.Error())
+		}
+		return true
+	}
+
+	return value != "0"
+}
+
+func setSafeSearch(userID int, on bool) error {
+	key := fmt.Sprintf("SafeSearch:%d", userID)
+
+	if on {
+		return redis.Instance().Del(context.Background(), key).Err()
+	}
+
+	return redis.Instance().Set(context.Background(), key, "0", 0).Err()
+}
+
+func getSortsAndSearchType(pop bool, userID, messageID int) ([]any, searchState, error) {
 	sKey := fmt.Sprintf("Sorts:%d:%d", userID, messageID)
 	tKey := fmt.Sprintf("SearchType:%d:%d", userID, messageID)
 
@@ -508,31 +724,26 @@ return {latestSort, tVal}
 	result, err := redis.Instance().Eval(context.Background(), script, []string{sKey, tKey}).Result()
 	if err != nil {
 		logger.App().Errorf("eval error : %s", err.Error())
-		return []float64{}, 0, err
+		return []any{}, searchState{}, err
 	}
 
 	res := result.([]interface{})
 
 	logger.App().Infof("================== %+v", res)
 
-	sorts := make([]float64, 0)
+	sorts := make([]any, 0)
 	if res[0] != nil {
 		sortStr := cast.ToString(res[0])
 		if err = sonic.Unmarshal([]byte(sortStr), &sorts); err != nil {
 			logger.App().Errorf("unmarshal error : %s", err.Error())
-			return []float64{}, 0, err
+			return []any{}, searchState{}, err
 		}
 	}
 
-	st := uint8(0)
-	if res[1] != nil {
-		st = cast.ToUint8(res[1])
-	}
-
-	return sorts, st, nil
+	return sorts, parseSearchState(res[1]), nil
 }
 
-func saveSortsAndSearchType(userID, messageID int, sorts []float64, st uint8) error {
+func saveSortsAndSearchType(userID, messageID int, sorts []any, state searchState) error {
 	sKey := fmt.Sprintf("Sorts:%d:%d", userID, messageID)
 	tKey := fmt.Sprintf("SearchType:%d:%d", userID, messageID)
 
@@ -544,13 +755,19 @@ func saveSortsAndSearchType(userID, messageID int, sorts []float64, st uint8) er
 	} else {
 		args = append(args, string(data))
 	}
-	args = append(args, strconv.Itoa(int(st)))
+
+	if data, err := sonic.MarshalString(&state); err != nil {
+		logger.App().Errorf("marshal error : %s", err.Error())
+		return err
+	} else {
+		args = append(args, data)
+	}
 
 	luaScript := `
 local sKey = KEYS[1]
 local tKey = KEYS[2]
 local expireSeconds = 180
-local uint8Value = ARGV[#ARGV]
+local stateValue = ARGV[#ARGV]
 
 if redis.call("EXISTS", sKey) == 0 then
 	redis.call("LPUSH", sKey, "[]")
@@ -561,7 +778,7 @@ for i = 1, #ARGV - 1 do
     redis.call("LPUSH", sKey, ARGV[i])
 end
 
-redis.call("SET", tKey, uint8Value)
+redis.call("SET", tKey, stateValue)
 redis.call("EXPIRE", sKey, expireSeconds)
 redis.call("EXPIRE", tKey, expireSeconds)
 return true
@@ -601,6 +818,28 @@ This channel can't displayed because it was used to spread pornographic content\
 https://imaodou\.xyz`, ParseModeMarkdownV2, generateMarkup([][][]string{}), fileID
 }
 
+// generateSafeSearchMarkup 按用户当前的安全搜索状态给出切换按钮
+func generateSafeSearchMarkup(userID int) map[string]any {
+	if getSafeSearch(userID) {
+		return generateMarkup([][][]string{{{"🔞显示限制内容", "", strings.Join([]string{OrderMore, BehaviorR18, BehaviorOn}, ".")}}})
+	}
+
+	return generateMarkup([][][]string{{{"✅开启安全搜索", "", strings.Join([]string{OrderMore, BehaviorR18, BehaviorOff}, ".")}}})
+}
+
+func behaviorSafeSearch(userID int, on bool) (string, string, map[string]any, error) {
+	if err := setSafeSearch(userID, on); err != nil {
+		return "", "", map[string]any{}, err
+	}
+
+	text := "🔞已显示限制内容，搜索结果将包含被标记的内容"
+	if on {
+		text = "✅已开启安全搜索，搜索结果将过滤被标记的内容"
+	}
+
+	return text, ParseModeText, generateSafeSearchMarkup(userID), nil
+}
+
 func behaviorFreeMusic() (string, string, map[string]any, string) {
 
 	fileID := ""
@@ -0,0 +1,32 @@
+package core
+
+import (
+	"search-service/core/search"
+	"testing"
+)
+
+func TestGenerateSearchType(t *testing.T) {
+	tests := []struct {
+		name string
+		st   uint8
+		want int
+	}{
+		{"all", 0, 8},
+		{"bot", search.SearchTypeBot, 8},
+		{"media", search.SearchTypeMedia, 9},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := generateSearchType(tt.st)
+			if len(got) != tt.want {
+				t.Fatalf("generateSearchType(%d) = %d buttons, want %d", tt.st, len(got), tt.want)
+			}
+			for _, button := range got {
+				if button[0] == SearchType2Behavior[tt.st] {
+					t.Fatalf("generateSearchType(%d) contains current type %q", tt.st, button[0])
+				}
+			}
+		})
+	}
+}
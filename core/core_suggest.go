@@ -0,0 +1,122 @@
+package core
+
+import (
+	"context"
+	"jarvis/dao/db/redis"
+	"jarvis/logger"
+	"net/http"
+	"search-service/core/search"
+	"strings"
+
+	"github.com/bytedance/sonic"
+	"github.com/gin-gonic/gin"
+	ONats "github.com/nats-io/nats.go"
+	"github.com/spf13/cast"
+)
+
+const (
+	SSSuggestSubject = "Search.Suggest"
+
+	suggestSize    = 10
+	suggestMaxSize = 20
+	suggestHotScan = 500 // 热搜榜只看前这么多个词
+)
+
+type SuggestRequest struct {
+	Q    string `json:"q"`
+	Size int    `json:"size"`
+}
+
+type SuggestResponse struct {
+	Suggestions []string `json:"suggestions"`
+	Error       string   `json:"error"`
+}
+
+// suggest 热搜榜中以 q 开头的词在前，其后是索引里的补全，去重后最多 size 个
+func suggest(q string, size int) ([]string, error) {
+	q = strings.TrimSpace(q)
+	if q == "" {
+		return []string{}, nil
+	}
+
+	if size <= 0 {
+		size = suggestSize
+	}
+	size = min(size, suggestMaxSize)
+
+	suggestions, seen := make([]string, 0, size), make(map[string]struct{})
+	add := func(word string) bool {
+		if _, exist := seen[word]; !exist {
+			seen[word] = struct{}{}
+			suggestions = append(suggestions, word)
+		}
+		return len(suggestions) < size
+	}
+
+	hots, err := redis.Instance().ZRevRange(context.Background(), "HotRankList", 0, suggestHotScan-1).Result()
+	if err != nil {
+		logger.App().Errorf("zrevrange HotRankList error : %s", err.Error())
+	}
+
+	for _, word := range hots {
+		if strings.HasPrefix(word, q) && !add(word) {
+			return suggestions, nil
+		}
+	}
+
+	completions, err := search.Complete(q, size)
+	if err != nil {
+		return suggestions, err
+	}
+
+	for _, word := range completions {
+		if !add(word) {
+			break
+		}
+	}
+
+	return suggestions, nil
+}
+
+// ========================================================================================================
+
+func doSuggest(msg *ONats.Msg) {
+	if msg.Reply == "" {
+		return
+	}
+
+	request := new(SuggestRequest)
+	response := &SuggestResponse{Suggestions: []string{}}
+
+	if err := sonic.Unmarshal(msg.Data, request); err != nil {
+		response.Error = err.Error()
+	} else if suggestions, err := suggest(request.Q, request.Size); err != nil {
+		response.Suggestions, response.Error = suggestions, err.Error()
+	} else {
+		response.Suggestions = suggestions
+	}
+
+	if response.Error != "" {
+		logger.App().Errorf("suggest error : %s - %s", response.Error, string(msg.Data))
+	}
+
+	data, err := sonic.Marshal(response)
+	if err != nil {
+		logger.App().Errorf("marshal suggest response error : %s", err.Error())
+		return
+	}
+
+	if err = msg.Respond(data); err != nil {
+		logger.App().Errorf("respond suggest error : %s", err.Error())
+	}
+}
+
+func doWebSuggest(ctx *gin.Context) {
+	suggestions, err := suggest(ctx.Query("q"), cast.ToInt(ctx.Query("size")))
+	if err != nil {
+		// 索引出错时热搜榜的结果照样返回
+		logger.App().Errorf("suggest [%s] error : %s", ctx.Query("q"), err.Error())
+	}
+
+	ctx.JSON(http.StatusOK, SuggestResponse{Suggestions: suggestions})
+}
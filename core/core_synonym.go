@@ -0,0 +1,48 @@
+package core
+
+import (
+	"jarvis/dao/db/mysql"
+	"jarvis/logger"
+	"search-service/core/search"
+	"strings"
+)
+
+// CacheSynonym 管理后台改完 search_synonym 后发到 JSSearchCacheSubject，重新写入 ES
+const CacheSynonym = "5"
+
+// Synonym 一行一条 Solr 格式的规则，如 "电影,影视,片" 或 "片子 => 电影"
+type Synonym struct {
+	ID      uint   `gorm:"column:id;not null;autoIncrement;primaryKey;comment:主键ID" json:"id"`
+	Rule    string `gorm:"column:rule;type:varchar(1024);not null;comment:同义词规则" json:"rule"`
+	Remark  string `gorm:"column:remark;type:varchar(255);not null;default:'';comment:备注" json:"remark"`
+	Created int64  `gorm:"column:created;not null;comment:时间戳(毫秒)" json:"created"`
+}
+
+func (Synonym) TableName() string { return "search_synonym" }
+
+func initSynonymTable() error {
+	return mysql.Instance().AutoMigrate(new(Synonym))
+}
+
+// loadSynonyms 同义词只在查询分析器上生效，写入 ES 后立即生效，不需要重建索引
+func loadSynonyms() error {
+	tmp := make([]*Synonym, 0)
+	if err := mysql.Instance().Model(new(Synonym)).Order("id").Find(&tmp).Error; err != nil {
+		return err
+	}
+
+	rules := make([]string, 0, len(tmp))
+	for _, item := range tmp {
+		if rule := strings.TrimSpace(item.Rule); rule != "" {
+			rules = append(rules, rule)
+		}
+	}
+
+	if err := search.SetSynonyms(rules); err != nil {
+		return err
+	}
+
+	logger.App().Infof("======= load synonyms success : %d", len(rules))
+
+	return nil
+}
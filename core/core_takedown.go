@@ -0,0 +1,236 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"jarvis/dao/db/mysql"
+	"jarvis/logger"
+	"jarvis/middleware/mq/nats"
+	"net/http"
+	"search-service/core/search"
+	"strings"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/gin-gonic/gin"
+	ONats "github.com/nats-io/nats.go"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	SSTakedownSubject = "Search.Takedown" // header 带 Authorization: Bearer <Token>，和 HTTP 接口使用同一批管理员
+
+	TakedownDelete  = "delete"  // 删除文档并屏蔽，防止重新写入后再出现
+	TakedownHide    = "hide"    // 只屏蔽，可恢复
+	TakedownRestore = "restore" // 解除屏蔽，已删除的文档不会恢复
+
+	CacheBlocklist = "4"
+)
+
+type Blocklist struct {
+	ID      uint   `gorm:"column:id;not null;autoIncrement;primaryKey;comment:主键ID" json:"id"`
+	Index   string `gorm:"column:index;type:varchar(32);not null;uniqueIndex:uk_index_field_value,priority:1;comment:索引 message/cog/bot" json:"index"`
+	Field   string `gorm:"column:field;type:varchar(16);not null;uniqueIndex:uk_index_field_value,priority:2;comment:字段 link/id" json:"field"`
+	Value   string `gorm:"column:value;type:varchar(255);not null;uniqueIndex:uk_index_field_value,priority:3;comment:值" json:"value"`
+	Created int64  `gorm:"column:created;not null;comment:时间戳(毫秒)" json:"created"`
+}
+
+func (Blocklist) TableName() string { return "search_blocklist" }
+
+type TakedownAudit struct {
+	ID       uint   `gorm:"column:id;not null;autoIncrement;primaryKey;comment:主键ID" json:"id"`
+	Operator string `gorm:"column:operator;type:varchar(64);not null;index:idx_operator;comment:操作人" json:"operator"`
+	Action   string `gorm:"column:action;type:varchar(16);not null;comment:delete/hide/restore" json:"action"`
+	Index    string `gorm:"column:index;type:varchar(32);not null;comment:索引" json:"index"`
+	Field    string `gorm:"column:field;type:varchar(16);not null;comment:字段" json:"field"`
+	Value    string `gorm:"column:value;type:varchar(255);not null;index:idx_value;comment:值" json:"value"`
+	Reason   string `gorm:"column:reason;type:varchar(512);not null;comment:原因" json:"reason"`
+	Affected uint64 `gorm:"column:affected;not null;comment:删除的文档数" json:"affected"`
+	Error    string `gorm:"column:error;type:varchar(512);not null;default:'';comment:失败原因，成功时为空" json:"error"`
+	Created  int64  `gorm:"column:created;not null;index:idx_created;comment:时间戳(毫秒)" json:"created"`
+}
+
+func (TakedownAudit) TableName() string { return "search_takedown_audit" }
+
+type TakedownRequest struct {
+	Operator string `json:"-"`      // 认证的管理员，不从请求体读取
+	Action   string `json:"action"` // delete/hide/restore
+	Index    string `json:"index"`  // message/cog/bot，bot 只能按 id
+	Link     string `json:"link"`
+	ID       string `json:"id"`
+	Reason   string `json:"reason"`
+}
+
+type TakedownResponse struct {
+	Affected uint64 `json:"affected"`
+	Error    string `json:"error"`
+}
+
+func initTakedownTables() error {
+	return mysql.Instance().AutoMigrate(new(Blocklist), new(TakedownAudit))
+}
+
+func loadBlocklist() error {
+	tmp := make([]*Blocklist, 0)
+	if err := mysql.Instance().Model(new(Blocklist)).Find(&tmp).Error; err != nil {
+		return err
+	}
+
+	entries := make([]search.BlockEntry, 0, len(tmp))
+	for _, item := range tmp {
+		entries = append(entries, search.BlockEntry{Index: item.Index, Field: item.Field, Value: item.Value})
+	}
+
+	search.SetBlocklist(entries)
+
+	logger.App().Infof("======= load blocklist success : %d", len(entries))
+
+	return nil
+}
+
+// takedown 执行下架并记录审计，成功后通知所有实例刷新屏蔽列表，失败的操作也会记录审计
+func takedown(request *TakedownRequest) (uint64, error) {
+	if request.Operator == "" {
+		return 0, errors.New("operator is required")
+	}
+
+	if request.Index != search.SeriesMessage && request.Index != search.IndexCog && request.Index != search.IndexBot {
+		return 0, errors.New(fmt.Sprintf("index must be %s, %s or %s", search.SeriesMessage, search.IndexCog, search.IndexBot))
+	}
+
+	if (request.Link == "") == (request.ID == "") {
+		return 0, errors.New("exactly one of link and id is required")
+	}
+
+	if request.Index == search.IndexBot && request.ID == "" {
+		return 0, errors.New(fmt.Sprintf("%s can only be taken down by id", search.IndexBot))
+	}
+
+	if request.Action != TakedownDelete && request.Action != TakedownHide && request.Action != TakedownRestore {
+		return 0, errors.New(fmt.Sprintf("action must be %s, %s or %s", TakedownDelete, TakedownHide, TakedownRestore))
+	}
+
+	field, value := search.BlockFieldLink, search.NormalizeLink(request.Link)
+	if request.ID != "" {
+		field, value = search.BlockFieldID, request.ID
+	}
+
+	affected, err := applyTakedown(request.Action, request.Index, field, value)
+
+	audit := &TakedownAudit{
+		Operator: request.Operator,
+		Action:   request.Action,
+		Index:    request.Index,
+		Field:    field,
+		Value:    value,
+		Reason:   request.Reason,
+		Affected: affected,
+		Created:  time.Now().UnixMilli(),
+	}
+	if err != nil {
+		audit.Error = err.Error()
+	}
+
+	if auditErr := mysql.Instance().Create(audit).Error; auditErr != nil {
+		logger.App().Errorf("create takedown audit error : %s - %+v", auditErr.Error(), *(audit))
+	}
+
+	if err != nil {
+		return affected, err
+	}
+
+	if err := loadBlocklist(); err != nil {
+		logger.App().Errorf("load blocklist error : %s", err.Error())
+	}
+
+	if err := nats.Instance().Publish(JSSearchCacheSubject, []byte(CacheBlocklist)); err != nil {
+		logger.App().Errorf("publish blocklist reload error : %s", err.Error())
+	}
+
+	logger.App().Infof("takedown [%s] %s %s=%s by [%s] : %d", request.Action, request.Index, field, value, request.Operator, affected)
+
+	return affected, nil
+}
+
+// applyTakedown 删除文档和修改屏蔽列表，返回删除的文档数，删除成功但屏蔽失败时也返回删除数
+func applyTakedown(action, index, field, value string) (uint64, error) {
+	affected := uint64(0)
+
+	switch action {
+	case TakedownDelete:
+		deleted, err := search.DeleteDocuments(index, field, value)
+		if err != nil {
+			return 0, err
+		}
+		affected = deleted
+
+		fallthrough
+	case TakedownHide:
+		if err := mysql.Instance().Clauses(clause.OnConflict{DoNothing: true}).Create(&Blocklist{
+			Index: index, Field: field, Value: value, Created: time.Now().UnixMilli(),
+		}).Error; err != nil {
+			return affected, err
+		}
+	case TakedownRestore:
+		if err := mysql.Instance().Where("`index` = ? AND field = ? AND value = ?", index, field, value).Delete(new(Blocklist)).Error; err != nil {
+			return 0, err
+		}
+	}
+
+	return affected, nil
+}
+
+// ========================================================================================================
+
+func doTakedown(msg *ONats.Msg) {
+	request := new(TakedownRequest)
+	response := new(TakedownResponse)
+
+	// 和 HTTP 接口一样认证，header 带 Authorization: Bearer <Token>
+	token, _ := strings.CutPrefix(msg.Header.Get("Authorization"), "Bearer ")
+	if request.Operator = adminName(token); token == "" || request.Operator == "" {
+		response.Error = "invalid bearer token"
+	} else if err := sonic.Unmarshal(msg.Data, request); err != nil {
+		response.Error = err.Error()
+	} else if affected, err := takedown(request); err != nil {
+		response.Affected, response.Error = affected, err.Error()
+	} else {
+		response.Affected = affected
+	}
+
+	if response.Error != "" {
+		logger.App().Errorf("takedown error : %s - %s", response.Error, string(msg.Data))
+	}
+
+	if msg.Reply == "" {
+		return
+	}
+
+	data, err := sonic.Marshal(response)
+	if err != nil {
+		logger.App().Errorf("marshal takedown response error : %s", err.Error())
+		return
+	}
+
+	if err = msg.Respond(data); err != nil {
+		logger.App().Errorf("respond takedown error : %s", err.Error())
+	}
+}
+
+func doWebTakedown(ctx *gin.Context) {
+	request := new(TakedownRequest)
+	if err := ctx.ShouldBindJSON(request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON: " + err.Error()})
+		return
+	}
+
+	request.Operator = ctx.GetString(ContextOperator)
+
+	affected, err := takedown(request)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, TakedownResponse{Affected: affected, Error: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, TakedownResponse{Affected: affected})
+}
@@ -1,16 +1,70 @@
 package core
 
 import (
+	"crypto/subtle"
+	"jarvis/logger"
 	"net/http"
 	"search-service/core/search"
+	"strings"
+	"sync/atomic"
 
 	"github.com/gin-gonic/gin"
+	"github.com/spf13/cast"
 )
 
+// ContextOperator 认证通过的管理员名字，用作审计的操作人
+const ContextOperator = "operator"
+
+// AdminConfig 管理接口的调用方，请求头带 Authorization: Bearer <Token>
+type AdminConfig struct {
+	Name  string
+	Token string
+}
+
+var _admins = []AdminConfig{}
+
+// adminName 按 token 找管理员，找不到时返回空
+func adminName(token string) string {
+	name := ""
+	for _, admin := range _admins {
+		if subtle.ConstantTimeCompare([]byte(admin.Token), []byte(token)) == 1 {
+			name = admin.Name
+		}
+	}
+
+	return name
+}
+
+// adminAuth 管理接口的认证，没有配置管理员时全部拒绝
+func adminAuth(ctx *gin.Context) {
+	token, ok := strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing bearer token"})
+		return
+	}
+
+	name := adminName(token)
+	if name == "" {
+		logger.App().Warnf("admin auth failed for %s %s from %s", ctx.Request.Method, ctx.Request.URL.Path, ctx.ClientIP())
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid bearer token"})
+		return
+	}
+
+	ctx.Set(ContextOperator, name)
+	ctx.Next()
+}
+
 type SearchRequest struct {
-	Type  uint8     `json:"type"`  // 0:all 1:groupt 2:channel 3:text 4:photo 5:video 6:voice 7:file 8:photo/video
-	Words string    `json:"words"` // 搜索关键词
-	Sort  []float64 `json:"sort"`
+	Type  uint8  `json:"type"`  // 0:all 1:groupt 2:channel 3:video 4:photo 5:voice 6:text 7:file 8:bot 9:photo/video
+	Words string `json:"words"` // 搜索关键词
+	Sort  []any  `json:"sort"`
+	// 排序方式 relevance/popular/newest/media，为空时使用默认，换排序方式时 sort 要从空开始
+	Profile string `json:"profile"`
+	// 用户语言，如 en、ru、fa，对应语言的字段加权
+	Language string `json:"language"`
+	// 发布时间范围，毫秒，[posted_from, posted_to)，0 表示不限，只对消息生效
+	PostedFrom int64 `json:"posted_from"`
+	PostedTo   int64 `json:"posted_to"`
 }
 
 func doSearch(ctx *gin.Context) {
@@ -29,7 +83,13 @@ func doSearch(ctx *gin.Context) {
 		return
 	}
 
-	response, err := search.Search(request.Type, request.Words, request.Sort)
+	response, err := search.Search(request.Type, request.Words, request.Sort, search.Options{
+		NSFW:       !getSafeSearch(cast.ToInt(uid)),
+		Profile:    request.Profile,
+		Language:   request.Language,
+		PostedFrom: request.PostedFrom,
+		PostedTo:   request.PostedTo,
+	})
 	if err != nil {
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON: " + err.Error()})
 		return
@@ -38,3 +98,41 @@ func doSearch(ctx *gin.Context) {
 	// 返回所有参数信息
 	ctx.JSON(http.StatusOK, response)
 }
+
+// 同一时间只允许一个迁移
+var _migrating atomic.Bool
+
+func doMigrate(ctx *gin.Context) {
+	index := ctx.Param("index")
+
+	if _, exist := _mappings[index]; !exist {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Unknown index: " + index})
+		return
+	}
+
+	if !_migrating.CompareAndSwap(false, true) {
+		ctx.JSON(http.StatusConflict, gin.H{"error": "Another migration is running"})
+		return
+	}
+
+	operator := ctx.GetString(ContextOperator)
+	logger.App().Infof("migrate [%s] requested by [%s]", index, operator)
+
+	// reindex 可能很久，后台执行，结果看日志
+	go func() {
+		defer _migrating.Store(false)
+
+		if err := Migrate(index); err != nil {
+			logger.App().Errorf("migrate [%s] error : %s", index, err.Error())
+			return
+		}
+
+		logger.App().Infof("migrate [%s] by [%s] finished", index, operator)
+	}()
+
+	ctx.JSON(http.StatusAccepted, gin.H{"index": index})
+}
+
+func doStats(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{"search": search.Stats(), "pools": poolStats(), "mission": missionStats()})
+}
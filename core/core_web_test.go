@@ -0,0 +1,27 @@
+package core
+
+import "testing"
+
+func TestAdminName(t *testing.T) {
+	_admins = []AdminConfig{{Name: "alice", Token: "token-a"}, {Name: "bob", Token: "token-b"}}
+	t.Cleanup(func() { _admins = []AdminConfig{} })
+
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"first", "token-a", "alice"},
+		{"second", "token-b", "bob"},
+		{"unknown", "token-c", ""},
+		{"empty", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := adminName(tt.token); got != tt.want {
+				t.Fatalf("adminName(%q) = %q, want %q", tt.token, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package core
+
+import (
+	"jarvis/logger"
+	"sort"
+	"sync"
+)
+
+const (
+	PoolSearch    = "search"    // 会查询 ES 的请求，如关键词搜索、翻页、inline
+	PoolMenu      = "menu"      // 菜单和固定按钮
+	PoolAnalytics = "analytics" // 置顶检查和搜索词统计，满了直接丢弃
+)
+
+var (
+	_pools = map[string]*workerPool{}
+
+	_defaultPools = []PoolConfig{
+		{Name: PoolSearch, Workers: 64, Queue: 1024},
+		{Name: PoolMenu, Workers: 16, Queue: 256},
+		{Name: PoolAnalytics, Workers: 8, Queue: 10000},
+	}
+)
+
+type PoolConfig struct {
+	Name    string
+	Workers int
+	Queue   int
+}
+
+type PoolStats struct {
+	Name      string `json:"name"`
+	Workers   int    `json:"workers"`
+	Busy      int    `json:"busy"`
+	Queued    int    `json:"queued"`
+	Capacity  int    `json:"capacity"`
+	Processed uint64 `json:"processed"`
+	Rejected  uint64 `json:"rejected"`
+}
+
+type workerPool struct {
+	name    string
+	workers int
+	queue   chan func()
+	wg      *sync.WaitGroup
+	mutex   *sync.Mutex
+	stats   PoolStats
+}
+
+func newWorkerPool(config PoolConfig) *workerPool {
+	if config.Workers <= 0 {
+		config.Workers = 1
+	}
+	if config.Queue < 0 {
+		config.Queue = 0
+	}
+
+	return &workerPool{
+		name:    config.Name,
+		workers: config.Workers,
+		queue:   make(chan func(), config.Queue),
+		wg:      new(sync.WaitGroup),
+		mutex:   new(sync.Mutex),
+		stats:   PoolStats{Name: config.Name, Workers: config.Workers, Capacity: config.Queue},
+	}
+}
+
+// submit 不阻塞，队列满时返回 false，由调用方决定如何降级
+func (wp *workerPool) submit(task func()) bool {
+	select {
+	case wp.queue <- task:
+		return true
+	default:
+		wp.mutex.Lock()
+		wp.stats.Rejected++
+		wp.mutex.Unlock()
+		return false
+	}
+}
+
+func (wp *workerPool) Start() {
+	for i := 0; i < wp.workers; i++ {
+		wp.wg.Add(1)
+		go wp.work()
+	}
+}
+
+// Wait 等待所有 worker 处理完队列中剩余的任务后退出
+func (wp *workerPool) Wait() {
+	wp.wg.Wait()
+}
+
+func (wp *workerPool) work() {
+	defer wp.wg.Done()
+
+	for {
+		select {
+		case <-_close:
+			{
+				for {
+					select {
+					case task := <-wp.queue:
+						wp.run(task)
+					default:
+						return
+					}
+				}
+			}
+		case task := <-wp.queue:
+			{
+				wp.run(task)
+			}
+		}
+	}
+}
+
+func (wp *workerPool) run(task func()) {
+	wp.mutex.Lock()
+	wp.stats.Busy++
+	wp.mutex.Unlock()
+
+	defer func() {
+		wp.mutex.Lock()
+		wp.stats.Busy--
+		wp.stats.Processed++
+		wp.mutex.Unlock()
+	}()
+
+	task()
+}
+
+func (wp *workerPool) Stats() PoolStats {
+	wp.mutex.Lock()
+	defer wp.mutex.Unlock()
+
+	stats := wp.stats
+	stats.Queued = len(wp.queue)
+
+	return stats
+}
+
+// initPools 未配置的类别使用默认值
+func initPools(configs []PoolConfig) {
+	pools := make(map[string]*workerPool)
+	for _, config := range configs {
+		pools[config.Name] = newWorkerPool(config)
+	}
+
+	for _, config := range _defaultPools {
+		if _, exist := pools[config.Name]; !exist {
+			pools[config.Name] = newWorkerPool(config)
+		}
+	}
+
+	_pools = pools
+}
+
+// runPools 启动所有 worker，关闭时等队列处理完再通知 Shutdown
+func runPools() {
+	logger.App().Infoln("=================================================== start worker pools ===================================================")
+	defer logger.App().Infoln("=================================================== stop worker pools ===================================================")
+
+	for _, pool := range _pools {
+		pool.Start()
+	}
+
+	<-_close
+
+	for _, pool := range _pools {
+		pool.Wait()
+	}
+
+	close(_done)
+}
+
+// submit 提交到 name 对应的池，被拒绝时记录日志
+func submit(name, traceID string, task func()) bool {
+	pool, exist := _pools[name]
+	if !exist {
+		logger.App().Errorf("[%s] worker pool [%s] not found", traceID, name)
+		return false
+	}
+
+	if !pool.submit(task) {
+		logger.App().Warnf("[%s] worker pool [%s] is full, shed request", traceID, name)
+		return false
+	}
+
+	return true
+}
+
+func poolStats() []PoolStats {
+	stats := make([]PoolStats, 0, len(_pools))
+	for _, pool := range _pools {
+		stats = append(stats, pool.Stats())
+	}
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+
+	return stats
+}
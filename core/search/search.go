@@ -1,31 +1,90 @@
 package search
 
 import (
+	"errors"
+	"fmt"
 	"jarvis/logger"
-	"sync"
+	"sort"
+	"time"
 )
 
-func Init(index string, amount uint64) error {
+type PITConfig struct {
+	Index     string
+	Pool      uint64
+	KeepAlive time.Duration
+	Rotation  time.Duration
+}
+
+type Config struct {
+	PIT      []PITConfig
+	Rollover RolloverConfig
+	Ingest   IngestConfig
+	Ranking  RankingConfig
+	Profiles []ProfileConfig // 为空时使用内置的 relevance/popular/newest/media
+	Cache    CacheConfig
+}
+
+type Statistics struct {
+	PIT      []PITStats      `json:"pit"`
+	Rollover []RolloverStats `json:"rollover"`
+	Ingest   IngestStats     `json:"ingest"`
+	Cache    CacheStats      `json:"cache"`
+	Flight   FlightStats     `json:"flight"`
+}
+
+func Init(config Config) error {
 	logger.App().Infoln("=================================================== start init ===================================================")
 	defer logger.App().Infoln("=================================================== stop init ===================================================")
 
-	_pm = &pitManager{
-		index:   "message",
-		amount:  2,
-		close:   make(chan struct{}),
-		done:    make(chan struct{}),
-		mutex:   new(sync.Mutex),
-		last:    make([]string, 0),
-		current: make([]string, 0),
-		next:    make([]string, 0),
-		idx:     0,
+	pms := make(map[string]PITManager)
+	for _, pc := range config.PIT {
+		pms[pc.Index] = newPITManager(pc.Index, pc.Pool, pc.KeepAlive, pc.Rotation)
+	}
+
+	// 未配置的索引使用默认值
+	for _, index := range []string{IndexMessage, IndexCog, IndexBot} {
+		if _, exist := pms[index]; !exist {
+			pms[index] = newPITManager(index, 2, time.Minute*time.Duration(2), time.Minute)
+		}
 	}
 
+	_pms = pms
+	_rollover = config.Rollover
+	_indexer = newBulkIndexer(config.Ingest)
+	_ranking = config.Ranking.withDefaults()
+	_cache.configure(config.Cache)
+
+	profiles := defaultProfiles()
+	if len(config.Profiles) > 0 {
+		profiles = config.Profiles[:]
+	}
+
+	names := make(map[string]struct{}, len(profiles))
+	for _, profile := range profiles {
+		if profile.Name == "" || len(profile.Sort) == 0 {
+			return errors.New("ranking profile requires name and sort")
+		}
+		if _, exist := names[profile.Name]; exist {
+			return errors.New(fmt.Sprintf("duplicate ranking profile : %s", profile.Name))
+		}
+		names[profile.Name] = struct{}{}
+	}
+
+	_profiles = profiles
+
 	return nil
 }
 
 func Start() error {
-	go _pm.Start()
+	for _, pm := range _pms {
+		go pm.Start()
+	}
+
+	for _, rm := range _rms {
+		go rm.Start()
+	}
+
+	go _indexer.Start()
 
 	return nil
 }
@@ -34,7 +93,15 @@ func Shutdown() error {
 	logger.App().Infoln("=================================================== start shutdown search ===================================================")
 	defer logger.App().Infoln("=================================================== stop shutdown search ===================================================")
 
-	_pm.Shutdown()
+	for _, pm := range _pms {
+		pm.Shutdown()
+	}
+
+	for _, rm := range _rms {
+		rm.Shutdown()
+	}
+
+	_indexer.Shutdown()
 
 	return nil
 }
@@ -45,3 +112,25 @@ func LoadCache() error {
 
 	return nil
 }
+
+func Stats() Statistics {
+	statistics := Statistics{PIT: make([]PITStats, 0, len(_pms)), Rollover: make([]RolloverStats, 0, len(_rms))}
+
+	for _, pm := range _pms {
+		statistics.PIT = append(statistics.PIT, pm.Stats())
+	}
+
+	sort.Slice(statistics.PIT, func(i, j int) bool { return statistics.PIT[i].Index < statistics.PIT[j].Index })
+
+	for _, rm := range _rms {
+		statistics.Rollover = append(statistics.Rollover, rm.Stats())
+	}
+
+	sort.Slice(statistics.Rollover, func(i, j int) bool { return statistics.Rollover[i].Series < statistics.Rollover[j].Series })
+
+	statistics.Ingest = _indexer.Stats()
+	statistics.Cache = _cache.Stats()
+	statistics.Flight = _flight.Stats()
+
+	return statistics
+}
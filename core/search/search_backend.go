@@ -0,0 +1,117 @@
+package search
+
+import (
+	"context"
+	"time"
+)
+
+// Backend 搜索引擎后端，查询体沿用 elasticsearch 的 DSL
+type Backend interface {
+	// Search 执行查询，body 中带 pit 时 index 为空
+	Search(ctx context.Context, index string, body map[string]any) ([]byte, error)
+	// Analyze 使用指定分词器分词
+	Analyze(ctx context.Context, analyzer, text string) ([]string, error)
+	// OpenPIT 打开一个 point in time
+	OpenPIT(ctx context.Context, index, keepAlive string) (string, error)
+	// ClosePIT 关闭一个 point in time
+	ClosePIT(ctx context.Context, id string) error
+	// IndexExists 索引是否存在
+	IndexExists(ctx context.Context, index string) (bool, error)
+	// CreateIndex 按 body 中的 settings/mappings/aliases 创建索引
+	CreateIndex(ctx context.Context, index, body string) error
+	// DeleteIndex 删除索引
+	DeleteIndex(ctx context.Context, index string) error
+	// BlockWrites 禁止写入索引，之后的写入和删除都会失败，查询不受影响
+	BlockWrites(ctx context.Context, index string) error
+	// UnblockWrites 恢复被 BlockWrites 禁止的写入
+	UnblockWrites(ctx context.Context, index string) error
+	// PutIndexTemplate 创建或覆盖索引模板
+	PutIndexTemplate(ctx context.Context, name, body string) error
+	// GetAlias 返回别名指向的索引及其中的写索引，别名不存在时返回空
+	GetAlias(ctx context.Context, alias string) ([]string, string, error)
+	// UpdateAliases 原子地执行一组别名操作，如 {"add": {"index": "...", "alias": "..."}}
+	UpdateAliases(ctx context.Context, actions []map[string]any) error
+	// Rollover 满足任一条件时滚动写别名，返回新索引名，未滚动时为空
+	Rollover(ctx context.Context, alias string, conditions map[string]any) (string, error)
+	// GetMapping 返回各索引的 mappings，index 可以是别名
+	GetMapping(ctx context.Context, index string) (map[string]map[string]any, error)
+	// PutMapping 给已有的索引增加字段，body 为 {"properties": {...}}
+	PutMapping(ctx context.Context, index, body string) error
+	// Reindex 把 source 的全部文档复制到 dest，返回复制的文档数
+	Reindex(ctx context.Context, source, dest string) (uint64, error)
+	// DeleteByQuery 删除 index 中命中 query 的文档，返回删除条数
+	DeleteByQuery(ctx context.Context, index string, query map[string]any) (uint64, error)
+	// Bulk 批量写入，以 ID 作为文档 _id 覆盖写，返回失败的条目，error 只表示整个请求失败
+	Bulk(ctx context.Context, items []BulkItem) ([]BulkFailure, error)
+	// RequirePlugins 集群中有节点缺少这些插件时返回错误，说明缺少哪些
+	RequirePlugins(ctx context.Context, plugins []string) error
+	// PutSynonyms 整体替换同义词集合，rules 为 Solr 格式，引用它的 updateable 分析器会自动重新加载
+	PutSynonyms(ctx context.Context, set string, rules []string) error
+}
+
+type BulkItem struct {
+	Index  string
+	ID     string
+	Source map[string]any
+}
+
+type BulkFailure struct {
+	Position int // 在 items 中的下标
+	Status   int
+	Reason   string
+}
+
+// Retryable 限流和服务端错误可以重试，其余是文档本身的问题
+func (bf BulkFailure) Retryable() bool {
+	return bf.Status == 429 || bf.Status >= 500
+}
+
+var _backend Backend = new(esBackend)
+
+func Instance() Backend { return _backend }
+
+// RequirePlugins 建索引之前检查 mapping 用到的分析插件，缺少时报出缺少的插件，而不是建索引时的 unknown char_filter
+func RequirePlugins(plugins ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(10))
+	defer cancel()
+
+	return _backend.RequirePlugins(ctx, plugins)
+}
+
+// SetBackend 替换搜索后端，需在 Init 之前调用
+func SetBackend(backend Backend) { _backend = backend }
+
+// Analyze 使用 ik_smart 对文本分词
+func Analyze(text string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*time.Duration(3000))
+	defer cancel()
+
+	return _backend.Analyze(ctx, "ik_smart", text)
+}
+
+// EnsureIndex 索引不存在时按 mapping 创建 <index>-v<version>，并以 index 为别名，方便之后迁移时切换
+func EnsureIndex(index, mapping string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(10))
+	defer cancel()
+
+	exist, err := _backend.IndexExists(ctx, index)
+	if err != nil {
+		return err
+	}
+
+	if exist {
+		return nil
+	}
+
+	_, version, err := parseMapping(mapping)
+	if err != nil {
+		return err
+	}
+
+	body, err := withAlias(mapping, index)
+	if err != nil {
+		return err
+	}
+
+	return _backend.CreateIndex(ctx, versionedIndex(index, version), body)
+}
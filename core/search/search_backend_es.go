@@ -0,0 +1,631 @@
+package search
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"jarvis/dao/db/elasticsearch"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cast"
+)
+
+type esBackend struct{}
+
+func (eb *esBackend) Search(ctx context.Context, index string, body map[string]any) ([]byte, error) {
+	// 序列化为 JSON
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(body); err != nil {
+		return nil, err
+	}
+
+	// 带 pit 的请求不能指定索引
+	indices := make([]string, 0)
+	if index != "" {
+		indices = append(indices, index)
+	}
+
+	// 构建 Search 请求
+	res, err := elasticsearch.Instance().Search(
+		elasticsearch.Instance().Search.WithContext(ctx),
+		elasticsearch.Instance().Search.WithIndex(indices...),
+		elasticsearch.Instance().Search.WithBody(&buf),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.IsError() {
+		return nil, errors.New(fmt.Sprintf("%s : %s", res.Status(), res.String()))
+	}
+
+	return io.ReadAll(res.Body)
+}
+
+func (eb *esBackend) Analyze(ctx context.Context, analyzer, text string) ([]string, error) {
+	// 构建分析请求体
+	body, err := json.Marshal(map[string]any{"analyzer": analyzer, "text": text})
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := elasticsearch.Instance().Indices.Analyze(
+		elasticsearch.Instance().Indices.Analyze.WithBody(bytes.NewReader(body)),
+		elasticsearch.Instance().Indices.Analyze.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.IsError() {
+		return nil, errors.New(res.String())
+	}
+
+	var result struct {
+		Tokens []struct {
+			Token string `json:"token"`
+		} `json:"tokens"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	tokens := make([]string, 0, len(result.Tokens))
+	for _, t := range result.Tokens {
+		tokens = append(tokens, t.Token)
+	}
+
+	return tokens, nil
+}
+
+func (eb *esBackend) OpenPIT(ctx context.Context, index, keepAlive string) (string, error) {
+	res, err := elasticsearch.Instance().OpenPointInTime(
+		[]string{index}, keepAlive,
+		elasticsearch.Instance().OpenPointInTime.WithContext(ctx),
+	)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.IsError() {
+		return "", errors.New(res.String())
+	}
+
+	var result struct {
+		ID string `json:"id"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return "", err
+	}
+
+	return result.ID, nil
+}
+
+func (eb *esBackend) ClosePIT(ctx context.Context, id string) error {
+	res, err := elasticsearch.Instance().ClosePointInTime(
+		elasticsearch.Instance().ClosePointInTime.WithContext(ctx),
+		elasticsearch.Instance().ClosePointInTime.WithBody(
+			strings.NewReader(
+				fmt.Sprintf("{\"id\":\"%s\"}", id),
+			),
+		),
+	)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.IsError() {
+		return errors.New(fmt.Sprintf("%s : %s", id, res.String()))
+	}
+
+	return nil
+}
+
+func (eb *esBackend) IndexExists(ctx context.Context, index string) (bool, error) {
+	res, err := elasticsearch.Instance().Indices.Exists(
+		[]string{index},
+		elasticsearch.Instance().Indices.Exists.WithContext(ctx),
+	)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	switch res.StatusCode {
+	case 200:
+		return true, nil
+	case 404:
+		return false, nil
+	}
+
+	return false, errors.New(res.String())
+}
+
+func (eb *esBackend) CreateIndex(ctx context.Context, index, body string) error {
+	res, err := elasticsearch.Instance().Indices.Create(
+		index,
+		elasticsearch.Instance().Indices.Create.WithContext(ctx),
+		elasticsearch.Instance().Indices.Create.WithBody(strings.NewReader(body)),
+	)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.IsError() {
+		return errors.New(res.String())
+	}
+
+	return nil
+}
+
+func (eb *esBackend) DeleteIndex(ctx context.Context, index string) error {
+	res, err := elasticsearch.Instance().Indices.Delete(
+		[]string{index},
+		elasticsearch.Instance().Indices.Delete.WithContext(ctx),
+	)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.IsError() {
+		return errors.New(res.String())
+	}
+
+	return nil
+}
+
+func (eb *esBackend) BlockWrites(ctx context.Context, index string) error {
+	res, err := elasticsearch.Instance().Indices.AddBlock(
+		[]string{index}, "write",
+		elasticsearch.Instance().Indices.AddBlock.WithContext(ctx),
+	)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.IsError() {
+		return errors.New(res.String())
+	}
+
+	return nil
+}
+
+func (eb *esBackend) UnblockWrites(ctx context.Context, index string) error {
+	res, err := elasticsearch.Instance().Indices.PutSettings(
+		strings.NewReader(`{"index.blocks.write": false}`),
+		elasticsearch.Instance().Indices.PutSettings.WithIndex(index),
+		elasticsearch.Instance().Indices.PutSettings.WithContext(ctx),
+	)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.IsError() {
+		return errors.New(res.String())
+	}
+
+	return nil
+}
+
+func (eb *esBackend) PutIndexTemplate(ctx context.Context, name, body string) error {
+	res, err := elasticsearch.Instance().Indices.PutIndexTemplate(
+		name, strings.NewReader(body),
+		elasticsearch.Instance().Indices.PutIndexTemplate.WithContext(ctx),
+	)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.IsError() {
+		return errors.New(res.String())
+	}
+
+	return nil
+}
+
+func (eb *esBackend) GetAlias(ctx context.Context, alias string) ([]string, string, error) {
+	res, err := elasticsearch.Instance().Indices.GetAlias(
+		elasticsearch.Instance().Indices.GetAlias.WithContext(ctx),
+		elasticsearch.Instance().Indices.GetAlias.WithName(alias),
+	)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.StatusCode == 404 {
+		return []string{}, "", nil
+	}
+
+	if res.IsError() {
+		return nil, "", errors.New(res.String())
+	}
+
+	// {"message-000001":{"aliases":{"message-write":{"is_write_index":true}}}}
+	var result map[string]struct {
+		Aliases map[string]struct {
+			IsWriteIndex *bool `json:"is_write_index"`
+		} `json:"aliases"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, "", err
+	}
+
+	indices, write := make([]string, 0, len(result)), ""
+	for index, item := range result {
+		indices = append(indices, index)
+		if flag := item.Aliases[alias].IsWriteIndex; flag != nil && *flag {
+			write = index
+		}
+	}
+
+	// 只指向一个索引且未显式设置时，该索引即写索引
+	if write == "" && len(indices) == 1 {
+		write = indices[0]
+	}
+
+	return indices, write, nil
+}
+
+func (eb *esBackend) UpdateAliases(ctx context.Context, actions []map[string]any) error {
+	body, err := json.Marshal(map[string]any{"actions": actions})
+	if err != nil {
+		return err
+	}
+
+	res, err := elasticsearch.Instance().Indices.UpdateAliases(
+		bytes.NewReader(body),
+		elasticsearch.Instance().Indices.UpdateAliases.WithContext(ctx),
+	)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.IsError() {
+		return errors.New(res.String())
+	}
+
+	return nil
+}
+
+func (eb *esBackend) Rollover(ctx context.Context, alias string, conditions map[string]any) (string, error) {
+	body, err := json.Marshal(map[string]any{"conditions": conditions})
+	if err != nil {
+		return "", err
+	}
+
+	res, err := elasticsearch.Instance().Indices.Rollover(
+		alias,
+		elasticsearch.Instance().Indices.Rollover.WithContext(ctx),
+		elasticsearch.Instance().Indices.Rollover.WithBody(bytes.NewReader(body)),
+	)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.IsError() {
+		return "", errors.New(res.String())
+	}
+
+	var result struct {
+		NewIndex   string `json:"new_index"`
+		RolledOver bool   `json:"rolled_over"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return "", err
+	}
+
+	if !result.RolledOver {
+		return "", nil
+	}
+
+	return result.NewIndex, nil
+}
+
+func (eb *esBackend) GetMapping(ctx context.Context, index string) (map[string]map[string]any, error) {
+	res, err := elasticsearch.Instance().Indices.GetMapping(
+		elasticsearch.Instance().Indices.GetMapping.WithContext(ctx),
+		elasticsearch.Instance().Indices.GetMapping.WithIndex(index),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.IsError() {
+		return nil, errors.New(fmt.Sprintf("%s : %s", res.Status(), res.String()))
+	}
+
+	var result map[string]struct {
+		Mappings map[string]any `json:"mappings"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	mappings := make(map[string]map[string]any, len(result))
+	for name, item := range result {
+		mappings[name] = item.Mappings
+	}
+
+	return mappings, nil
+}
+
+func (eb *esBackend) PutMapping(ctx context.Context, index, body string) error {
+	res, err := elasticsearch.Instance().Indices.PutMapping(
+		[]string{index}, strings.NewReader(body),
+		elasticsearch.Instance().Indices.PutMapping.WithContext(ctx),
+	)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.IsError() {
+		return errors.New(res.String())
+	}
+
+	return nil
+}
+
+func (eb *esBackend) Reindex(ctx context.Context, source, dest string) (uint64, error) {
+	body, err := json.Marshal(map[string]any{
+		"source": map[string]any{"index": source},
+		"dest":   map[string]any{"index": dest},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := elasticsearch.Instance().Reindex(
+		bytes.NewReader(body),
+		elasticsearch.Instance().Reindex.WithContext(ctx),
+		elasticsearch.Instance().Reindex.WithRefresh(true),
+		elasticsearch.Instance().Reindex.WithWaitForCompletion(true),
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.IsError() {
+		return 0, errors.New(res.String())
+	}
+
+	var result struct {
+		Total    uint64 `json:"total"`
+		Failures []any  `json:"failures"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+
+	if len(result.Failures) > 0 {
+		return result.Total, errors.New(fmt.Sprintf("reindex %s to %s has %d failures : %v", source, dest, len(result.Failures), result.Failures[0]))
+	}
+
+	return result.Total, nil
+}
+
+func (eb *esBackend) Bulk(ctx context.Context, items []BulkItem) ([]BulkFailure, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, item := range items {
+		if err := encoder.Encode(map[string]any{"index": map[string]any{"_index": item.Index, "_id": item.ID}}); err != nil {
+			return nil, err
+		}
+		if err := encoder.Encode(item.Source); err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := elasticsearch.Instance().Bulk(
+		&buf,
+		elasticsearch.Instance().Bulk.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.IsError() {
+		return nil, errors.New(fmt.Sprintf("%s : %s", res.Status(), res.String()))
+	}
+
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int `json:"status"`
+			Error  *struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	failures := make([]BulkFailure, 0)
+	if !result.Errors {
+		return failures, nil
+	}
+
+	for position, item := range result.Items {
+		for _, action := range item {
+			if action.Error != nil {
+				failures = append(failures, BulkFailure{
+					Position: position,
+					Status:   action.Status,
+					Reason:   fmt.Sprintf("%s : %s", action.Error.Type, action.Error.Reason),
+				})
+			}
+		}
+	}
+
+	return failures, nil
+}
+
+func (eb *esBackend) DeleteByQuery(ctx context.Context, index string, query map[string]any) (uint64, error) {
+	body, err := json.Marshal(map[string]any{"query": query})
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := elasticsearch.Instance().DeleteByQuery(
+		[]string{index}, bytes.NewReader(body),
+		elasticsearch.Instance().DeleteByQuery.WithContext(ctx),
+		elasticsearch.Instance().DeleteByQuery.WithRefresh(true),
+		elasticsearch.Instance().DeleteByQuery.WithConflicts("proceed"),
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.IsError() {
+		return 0, errors.New(res.String())
+	}
+
+	var result struct {
+		Deleted  uint64 `json:"deleted"`
+		Failures []any  `json:"failures"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+
+	if len(result.Failures) > 0 {
+		return result.Deleted, errors.New(fmt.Sprintf("delete by query on %s has %d failures : %v", index, len(result.Failures), result.Failures[0]))
+	}
+
+	return result.Deleted, nil
+}
+
+func (eb *esBackend) RequirePlugins(ctx context.Context, plugins []string) error {
+	res, err := elasticsearch.Instance().Nodes.Info(
+		elasticsearch.Instance().Nodes.Info.WithMetric("plugins"),
+		elasticsearch.Instance().Nodes.Info.WithContext(ctx),
+	)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.IsError() {
+		return errors.New(res.String())
+	}
+
+	var result struct {
+		Nodes map[string]struct {
+			Name    string `json:"name"`
+			Plugins []struct {
+				Name string `json:"name"`
+			} `json:"plugins"`
+		} `json:"nodes"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return err
+	}
+
+	missing := make([]string, 0)
+	for _, node := range result.Nodes {
+		installed := make(map[string]struct{}, len(node.Plugins))
+		for _, plugin := range node.Plugins {
+			installed[plugin.Name] = struct{}{}
+		}
+
+		for _, plugin := range plugins {
+			if _, exist := installed[plugin]; !exist {
+				missing = append(missing, fmt.Sprintf("%s on %s", plugin, node.Name))
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return errors.New(fmt.Sprintf("elasticsearch plugins are missing : %s", strings.Join(missing, ", ")))
+	}
+
+	return nil
+}
+
+func (eb *esBackend) PutSynonyms(ctx context.Context, set string, rules []string) error {
+	// synonyms set 接口和 mapping 中的 synonyms_set 从 8.10 开始支持
+	if err := requireVersion(ctx, 8, 10, "synonyms set"); err != nil {
+		return err
+	}
+
+	items := make([]map[string]any, 0, len(rules))
+	for _, rule := range rules {
+		items = append(items, map[string]any{"synonyms": rule})
+	}
+
+	body, err := json.Marshal(map[string]any{"synonyms_set": items})
+	if err != nil {
+		return err
+	}
+
+	res, err := elasticsearch.Instance().SynonymsPutSynonym(
+		set, bytes.NewReader(body),
+		elasticsearch.Instance().SynonymsPutSynonym.WithContext(ctx),
+	)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.IsError() {
+		return errors.New(res.String())
+	}
+
+	return nil
+}
+
+// requireVersion 集群版本低于 major.minor 时返回错误，提示 feature 需要升级
+func requireVersion(ctx context.Context, major, minor int, feature string) error {
+	res, err := elasticsearch.Instance().Info(elasticsearch.Instance().Info.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.IsError() {
+		return errors.New(res.String())
+	}
+
+	var result struct {
+		Version struct {
+			Number string `json:"number"`
+		} `json:"version"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return err
+	}
+
+	parts := strings.SplitN(result.Version.Number, ".", 3)
+	if len(parts) < 2 {
+		return errors.New(fmt.Sprintf("unknown elasticsearch version [%s]", result.Version.Number))
+	}
+
+	if v1, v2 := cast.ToInt(parts[0]), cast.ToInt(parts[1]); v1 < major || (v1 == major && v2 < minor) {
+		return errors.New(fmt.Sprintf("%s requires elasticsearch %d.%d or later, got %s", feature, major, minor, result.Version.Number))
+	}
+
+	return nil
+}
@@ -0,0 +1,1237 @@
+package search
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/bytedance/sonic"
+	"github.com/spf13/cast"
+)
+
+// MemoryBackend 纯内存的搜索后端，只实现了本服务用到的 DSL 子集，用于测试
+type MemoryBackend struct {
+	mutex     *sync.RWMutex
+	indices   map[string]*memoryIndex
+	aliases   map[string]*memoryAlias
+	templates map[string]*memoryTemplate
+	pits      map[string]string // pit id -> index or alias
+	synonyms  map[string][]string
+	seq       uint64
+}
+
+type memoryIndex struct {
+	body     string
+	mappings map[string]any
+	docs     []*memoryDoc
+	blocked  bool // BlockWrites 之后 Bulk 和 DeleteByQuery 失败，Put 和 Reindex 的目标不受影响
+}
+
+type memoryAlias struct {
+	indices []string
+	write   string
+}
+
+type memoryTemplate struct {
+	patterns []string
+	mappings map[string]any
+	aliases  map[string]any
+}
+
+type memoryDoc struct {
+	index  string
+	id     string
+	seq    uint64
+	source map[string]any
+}
+
+type memoryHit struct {
+	doc   *memoryDoc
+	score float64
+	sort  []any
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		mutex:     new(sync.RWMutex),
+		indices:   make(map[string]*memoryIndex),
+		aliases:   make(map[string]*memoryAlias),
+		templates: make(map[string]*memoryTemplate),
+		pits:      make(map[string]string),
+		synonyms:  make(map[string][]string),
+		seq:       0,
+	}
+}
+
+// Put 写入或覆盖一条文档，index 为别名时写入其写索引，索引不存在时自动创建
+func (mb *MemoryBackend) Put(index, id string, source map[string]any) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	index = mb.writeIndex(index)
+
+	idx, exist := mb.indices[index]
+	if !exist {
+		idx = &memoryIndex{docs: make([]*memoryDoc, 0)}
+		mb.indices[index] = idx
+	}
+
+	mb.seq++
+
+	for i, doc := range idx.docs {
+		if doc.id == id {
+			idx.docs[i] = &memoryDoc{index: index, id: id, seq: doc.seq, source: source}
+			return
+		}
+	}
+
+	idx.docs = append(idx.docs, &memoryDoc{index: index, id: id, seq: mb.seq, source: source})
+}
+
+// resolve 把索引名或别名展开成实际索引，调用方需持有锁
+// writeIndex 写入别名时的实际索引，和 ES 一样只有一个索引的别名不需要指定写索引，调用方持有锁
+func (mb *MemoryBackend) writeIndex(name string) string {
+	alias, exist := mb.aliases[name]
+	switch {
+	case !exist:
+		return name
+	case alias.write != "":
+		return alias.write
+	case len(alias.indices) == 1:
+		return alias.indices[0]
+	}
+
+	return name
+}
+
+func (mb *MemoryBackend) resolve(name string) ([]string, bool) {
+	if _, exist := mb.indices[name]; exist {
+		return []string{name}, true
+	}
+
+	if alias, exist := mb.aliases[name]; exist {
+		return alias.indices[:], true
+	}
+
+	return nil, false
+}
+
+func (mb *MemoryBackend) Search(_ context.Context, index string, body map[string]any) ([]byte, error) {
+	if pit, ok := body["pit"].(map[string]any); ok {
+		mb.mutex.RLock()
+		index = mb.pits[cast.ToString(pit["id"])]
+		mb.mutex.RUnlock()
+
+		if index == "" {
+			return nil, fmt.Errorf("404 Not Found : no such pit [%v]", pit["id"])
+		}
+	}
+
+	mb.mutex.RLock()
+	indices, exist := mb.resolve(index)
+	docs := make([]*memoryDoc, 0)
+	for _, name := range indices {
+		docs = append(docs, mb.indices[name].docs...)
+	}
+	mb.mutex.RUnlock()
+
+	if !exist {
+		return nil, fmt.Errorf("404 Not Found : no such index [%s]", index)
+	}
+
+	query, _ := body["query"].(map[string]any)
+
+	hits := make([]*memoryHit, 0)
+	for _, doc := range docs {
+		matched, score, err := evalQuery(query, doc.source)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			hits = append(hits, &memoryHit{doc: doc, score: score})
+		}
+	}
+
+	// 排序，带 pit 时追加隐式的 _shard_doc
+	specs := parseSortSpecs(body["sort"])
+	if _, ok := body["pit"]; ok {
+		specs = append(specs, sortSpec{field: "_shard_doc"})
+	}
+
+	for _, hit := range hits {
+		hit.sort = make([]any, 0, len(specs))
+		for _, spec := range specs {
+			hit.sort = append(hit.sort, spec.value(hit))
+		}
+	}
+
+	sort.SliceStable(hits, func(i, j int) bool {
+		return compareSort(specs, hits[i].sort, hits[j].sort) < 0
+	})
+
+	if after, ok := body["search_after"]; ok {
+		cursor := toSlice(after)
+		filtered := make([]*memoryHit, 0)
+		for _, hit := range hits {
+			if compareSort(specs, hit.sort, cursor) > 0 {
+				filtered = append(filtered, hit)
+			}
+		}
+		hits = filtered
+	}
+
+	size := 10
+	if v, ok := body["size"]; ok {
+		size = cast.ToInt(v)
+	}
+	if len(hits) > size {
+		hits = hits[:size]
+	}
+
+	terms := collectTerms(query)
+	highlight, _ := body["highlight"].(map[string]any)
+
+	list := make([]map[string]any, 0, len(hits))
+	for _, hit := range hits {
+		item := map[string]any{
+			"_index":  hit.doc.index,
+			"_id":     hit.doc.id,
+			"_score":  hit.score,
+			"_source": hit.doc.source,
+			"sort":    hit.sort,
+		}
+		if highlight != nil {
+			item["highlight"] = highlightDoc(highlight, hit.doc.source, terms)
+		}
+		list = append(list, item)
+	}
+
+	return sonic.Marshal(map[string]any{
+		"hits": map[string]any{
+			"total": map[string]any{"value": len(list), "relation": "eq"},
+			"hits":  list,
+		},
+	})
+}
+
+func (mb *MemoryBackend) Analyze(_ context.Context, _, text string) ([]string, error) {
+	return memoryTokenize(text), nil
+}
+
+func (mb *MemoryBackend) OpenPIT(_ context.Context, index, _ string) (string, error) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	if _, exist := mb.resolve(index); !exist {
+		return "", fmt.Errorf("404 Not Found : no such index [%s]", index)
+	}
+
+	mb.seq++
+	id := fmt.Sprintf("pit-%d", mb.seq)
+	mb.pits[id] = index
+
+	return id, nil
+}
+
+func (mb *MemoryBackend) ClosePIT(_ context.Context, id string) error {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	if _, exist := mb.pits[id]; !exist {
+		return fmt.Errorf("%s : 404 Not Found", id)
+	}
+
+	delete(mb.pits, id)
+
+	return nil
+}
+
+func (mb *MemoryBackend) IndexExists(_ context.Context, index string) (bool, error) {
+	mb.mutex.RLock()
+	defer mb.mutex.RUnlock()
+
+	_, exist := mb.resolve(index)
+
+	return exist, nil
+}
+
+func (mb *MemoryBackend) CreateIndex(_ context.Context, index, body string) error {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	return mb.create(index, body)
+}
+
+// create 创建索引并挂上模板和 body 中声明的别名，调用方需持有锁
+func (mb *MemoryBackend) create(index, body string) error {
+	if _, exist := mb.resolve(index); exist {
+		return fmt.Errorf("400 Bad Request : index [%s] already exists", index)
+	}
+
+	aliases, mappings := make(map[string]any), map[string]any(nil)
+	for _, template := range mb.templates {
+		for _, pattern := range template.patterns {
+			if matched, _ := path.Match(pattern, index); matched {
+				for name, v := range template.aliases {
+					aliases[name] = v
+				}
+				mappings = template.mappings
+			}
+		}
+	}
+
+	var parsed map[string]any
+	if body != "" {
+		if err := sonic.UnmarshalString(body, &parsed); err != nil {
+			return fmt.Errorf("400 Bad Request : %s", err.Error())
+		}
+	}
+	if v, ok := parsed["aliases"].(map[string]any); ok {
+		for name, options := range v {
+			aliases[name] = options
+		}
+	}
+	if v, ok := parsed["mappings"].(map[string]any); ok {
+		mappings = v
+	}
+
+	mb.indices[index] = &memoryIndex{body: body, mappings: mappings, docs: make([]*memoryDoc, 0)}
+
+	for name, options := range aliases {
+		m, _ := options.(map[string]any)
+		mb.addAlias(index, name, cast.ToBool(m["is_write_index"]))
+	}
+
+	return nil
+}
+
+// addAlias 调用方需持有锁
+func (mb *MemoryBackend) addAlias(index, name string, write bool) {
+	alias, exist := mb.aliases[name]
+	if !exist {
+		alias = &memoryAlias{indices: make([]string, 0)}
+		mb.aliases[name] = alias
+	}
+
+	found := false
+	for _, v := range alias.indices {
+		if v == index {
+			found = true
+			break
+		}
+	}
+	if !found {
+		alias.indices = append(alias.indices, index)
+	}
+
+	if write {
+		alias.write = index
+	} else if alias.write == index {
+		alias.write = ""
+	}
+}
+
+// removeAlias 调用方需持有锁
+func (mb *MemoryBackend) removeAlias(index, name string) {
+	alias, exist := mb.aliases[name]
+	if !exist {
+		return
+	}
+
+	indices := make([]string, 0, len(alias.indices))
+	for _, v := range alias.indices {
+		if v != index {
+			indices = append(indices, v)
+		}
+	}
+	alias.indices = indices
+
+	if alias.write == index {
+		alias.write = ""
+	}
+
+	if len(alias.indices) == 0 {
+		delete(mb.aliases, name)
+	}
+}
+
+func (mb *MemoryBackend) DeleteIndex(_ context.Context, index string) error {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	if _, exist := mb.indices[index]; !exist {
+		return fmt.Errorf("404 Not Found : no such index [%s]", index)
+	}
+
+	delete(mb.indices, index)
+	for name := range mb.aliases {
+		mb.removeAlias(index, name)
+	}
+
+	return nil
+}
+
+func (mb *MemoryBackend) BlockWrites(_ context.Context, index string) error {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	idx, exist := mb.indices[index]
+	if !exist {
+		return fmt.Errorf("404 Not Found : no such index [%s]", index)
+	}
+
+	idx.blocked = true
+
+	return nil
+}
+
+func (mb *MemoryBackend) UnblockWrites(_ context.Context, index string) error {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	idx, exist := mb.indices[index]
+	if !exist {
+		return fmt.Errorf("404 Not Found : no such index [%s]", index)
+	}
+
+	idx.blocked = false
+
+	return nil
+}
+
+func (mb *MemoryBackend) PutIndexTemplate(_ context.Context, name, body string) error {
+	var parsed struct {
+		IndexPatterns []string `json:"index_patterns"`
+		Template      struct {
+			Mappings map[string]any `json:"mappings"`
+			Aliases  map[string]any `json:"aliases"`
+		} `json:"template"`
+	}
+	if err := sonic.UnmarshalString(body, &parsed); err != nil {
+		return fmt.Errorf("400 Bad Request : %s", err.Error())
+	}
+
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	mb.templates[name] = &memoryTemplate{
+		patterns: parsed.IndexPatterns,
+		mappings: parsed.Template.Mappings,
+		aliases:  parsed.Template.Aliases,
+	}
+
+	return nil
+}
+
+func (mb *MemoryBackend) GetAlias(_ context.Context, name string) ([]string, string, error) {
+	mb.mutex.RLock()
+	defer mb.mutex.RUnlock()
+
+	alias, exist := mb.aliases[name]
+	if !exist {
+		return []string{}, "", nil
+	}
+
+	write := alias.write
+	if write == "" && len(alias.indices) == 1 {
+		write = alias.indices[0]
+	}
+
+	return append([]string{}, alias.indices...), write, nil
+}
+
+func (mb *MemoryBackend) UpdateAliases(_ context.Context, actions []map[string]any) error {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	// 先整体校验，保证要么全部生效要么都不生效
+	for _, action := range actions {
+		for kind, raw := range action {
+			m, _ := raw.(map[string]any)
+			index := cast.ToString(m["index"])
+			if _, exist := mb.indices[index]; !exist {
+				return fmt.Errorf("404 Not Found : no such index [%s]", index)
+			}
+			if kind != "add" && kind != "remove" && kind != "remove_index" {
+				return fmt.Errorf("400 Bad Request : unknown alias action [%s]", kind)
+			}
+		}
+	}
+
+	for _, action := range actions {
+		for kind, raw := range action {
+			m, _ := raw.(map[string]any)
+			index, alias := cast.ToString(m["index"]), cast.ToString(m["alias"])
+
+			switch kind {
+			case "add":
+				mb.addAlias(index, alias, cast.ToBool(m["is_write_index"]))
+			case "remove":
+				mb.removeAlias(index, alias)
+			case "remove_index":
+				delete(mb.indices, index)
+				for name := range mb.aliases {
+					mb.removeAlias(index, name)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Rollover 内存后端只判断 max_docs，其余条件忽略，没有条件时无条件滚动
+func (mb *MemoryBackend) Rollover(_ context.Context, name string, conditions map[string]any) (string, error) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	alias, exist := mb.aliases[name]
+	if !exist {
+		return "", fmt.Errorf("404 Not Found : no such alias [%s]", name)
+	}
+
+	current := alias.write
+	if current == "" && len(alias.indices) == 1 {
+		current = alias.indices[0]
+	}
+	if current == "" {
+		return "", fmt.Errorf("400 Bad Request : alias [%s] has no write index", name)
+	}
+
+	if v, ok := conditions["max_docs"]; ok && len(mb.indices[current].docs) < cast.ToInt(v) {
+		return "", nil
+	}
+
+	// message-000001 -> message-000002
+	pos := strings.LastIndex(current, "-")
+	if pos < 0 {
+		return "", fmt.Errorf("400 Bad Request : index [%s] does not end with a number", current)
+	}
+	suffix := current[pos+1:]
+	next := fmt.Sprintf("%s-%0*d", current[:pos], len(suffix), cast.ToInt(strings.TrimLeft(suffix, "0"))+1)
+
+	if err := mb.create(next, ""); err != nil {
+		return "", err
+	}
+
+	mb.addAlias(current, name, false)
+	mb.addAlias(next, name, true)
+
+	return next, nil
+}
+
+func (mb *MemoryBackend) GetMapping(_ context.Context, index string) (map[string]map[string]any, error) {
+	mb.mutex.RLock()
+	defer mb.mutex.RUnlock()
+
+	indices, exist := mb.resolve(index)
+	if !exist {
+		return nil, fmt.Errorf("404 Not Found : no such index [%s]", index)
+	}
+
+	mappings := make(map[string]map[string]any, len(indices))
+	for _, name := range indices {
+		mappings[name] = mb.indices[name].mappings
+	}
+
+	return mappings, nil
+}
+
+// PutMapping 只合并 properties
+func (mb *MemoryBackend) PutMapping(_ context.Context, index, body string) error {
+	var parsed map[string]any
+	if err := sonic.UnmarshalString(body, &parsed); err != nil {
+		return fmt.Errorf("400 Bad Request : %s", err.Error())
+	}
+
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	idx, exist := mb.indices[index]
+	if !exist {
+		return fmt.Errorf("404 Not Found : no such index [%s]", index)
+	}
+
+	mappings := make(map[string]any, len(idx.mappings)+1)
+	for key, value := range idx.mappings {
+		mappings[key] = value
+	}
+
+	properties := make(map[string]any)
+	if current, ok := mappings["properties"].(map[string]any); ok {
+		for field, value := range current {
+			properties[field] = value
+		}
+	}
+	if added, ok := parsed["properties"].(map[string]any); ok {
+		for field, value := range added {
+			properties[field] = value
+		}
+	}
+	mappings["properties"] = properties
+
+	idx.mappings = mappings
+
+	return nil
+}
+
+func (mb *MemoryBackend) Reindex(_ context.Context, source, dest string) (uint64, error) {
+	mb.mutex.RLock()
+	indices, exist := mb.resolve(source)
+	docs := make([]*memoryDoc, 0)
+	for _, name := range indices {
+		docs = append(docs, mb.indices[name].docs...)
+	}
+	mb.mutex.RUnlock()
+
+	if !exist {
+		return 0, fmt.Errorf("404 Not Found : no such index [%s]", source)
+	}
+
+	for _, doc := range docs {
+		mb.Put(dest, doc.id, doc.source)
+	}
+
+	return uint64(len(docs)), nil
+}
+
+func (mb *MemoryBackend) DeleteByQuery(_ context.Context, index string, query map[string]any) (uint64, error) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	indices, exist := mb.resolve(index)
+	if !exist {
+		return 0, fmt.Errorf("404 Not Found : no such index [%s]", index)
+	}
+
+	for _, name := range indices {
+		if mb.indices[name].blocked {
+			return 0, fmt.Errorf("403 Forbidden : index [%s] blocked by: [FORBIDDEN/8/index write (api)]", name)
+		}
+	}
+
+	deleted := uint64(0)
+	for _, name := range indices {
+		idx := mb.indices[name]
+
+		docs := make([]*memoryDoc, 0, len(idx.docs))
+		for _, doc := range idx.docs {
+			matched, _, err := evalQuery(query, doc.source)
+			if err != nil {
+				return deleted, err
+			}
+			if matched {
+				deleted++
+				continue
+			}
+			docs = append(docs, doc)
+		}
+		idx.docs = docs
+	}
+
+	return deleted, nil
+}
+
+// RequirePlugins 内存后端不需要插件
+func (mb *MemoryBackend) RequirePlugins(_ context.Context, _ []string) error {
+	return nil
+}
+
+// PutSynonyms 只保存规则，查询时不做同义词展开
+func (mb *MemoryBackend) PutSynonyms(_ context.Context, set string, rules []string) error {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	mb.synonyms[set] = rules[:]
+
+	return nil
+}
+
+func (mb *MemoryBackend) Bulk(_ context.Context, items []BulkItem) ([]BulkFailure, error) {
+	failures := make([]BulkFailure, 0)
+
+	for position, item := range items {
+		if mb.blocked(item.Index) {
+			failures = append(failures, BulkFailure{
+				Position: position,
+				Status:   403,
+				Reason:   fmt.Sprintf("cluster_block_exception : index [%s] blocked by: [FORBIDDEN/8/index write (api)]", item.Index),
+			})
+			continue
+		}
+
+		mb.Put(item.Index, item.ID, item.Source)
+	}
+
+	return failures, nil
+}
+
+// blocked 写入的目标索引（别名时为写索引）是否禁止写入
+func (mb *MemoryBackend) blocked(index string) bool {
+	mb.mutex.RLock()
+	defer mb.mutex.RUnlock()
+
+	idx, exist := mb.indices[mb.writeIndex(index)]
+
+	return exist && idx.blocked
+}
+
+// ================================================================================================
+
+func evalQuery(query map[string]any, source map[string]any) (bool, float64, error) {
+	if len(query) == 0 {
+		return true, 1, nil
+	}
+
+	for kind, raw := range query {
+		clause, _ := raw.(map[string]any)
+
+		switch kind {
+		case "match_all":
+			return true, 1, nil
+		case "bool":
+			return evalBool(clause, source)
+		case "function_score":
+			return evalFunctionScore(clause, source)
+		case "constant_score":
+			inner, _ := clause["filter"].(map[string]any)
+			return evalQuery(inner, source)
+		case "match", "match_phrase":
+			for field, v := range clause {
+				text, operator := cast.ToString(v), ""
+				if m, ok := v.(map[string]any); ok {
+					text, operator = cast.ToString(m["query"]), cast.ToString(m["operator"])
+				}
+				score := matchText(kind == "match_phrase", text, fieldValue(source, field))
+				// operator and 要求所有分词都命中
+				if kind == "match" && strings.EqualFold(operator, "and") && score < float64(len(memoryTokenize(text))) {
+					return false, 0, nil
+				}
+				return score > 0, score, nil
+			}
+		case "multi_match":
+			text := cast.ToString(clause["query"])
+			phrase := cast.ToString(clause["type"]) == "phrase"
+			and := strings.EqualFold(cast.ToString(clause["operator"]), "and")
+			total := 0.0
+			for _, field := range cast.ToStringSlice(clause["fields"]) {
+				score := matchText(phrase, text, multiFieldValue(source, strings.SplitN(field, "^", 2)[0]))
+				if and && score < float64(len(memoryTokenize(text))) {
+					continue
+				}
+				total += score
+			}
+			return total > 0, total, nil
+		case "term":
+			for field, v := range clause {
+				if m, ok := v.(map[string]any); ok {
+					v = m["value"]
+				}
+				return equalValue(fieldValue(source, field), v), 0, nil
+			}
+		case "terms":
+			for field, v := range clause {
+				for _, item := range toSlice(v) {
+					if equalValue(fieldValue(source, field), item) {
+						return true, 0, nil
+					}
+				}
+				return false, 0, nil
+			}
+		case "prefix":
+			for field, v := range clause {
+				if m, ok := v.(map[string]any); ok {
+					v = m["value"]
+				}
+				return strings.HasPrefix(cast.ToString(fieldValue(source, field)), cast.ToString(v)), 0, nil
+			}
+		case "exists":
+			return fieldValue(source, cast.ToString(clause["field"])) != nil, 0, nil
+		case "range":
+			for field, v := range clause {
+				bounds, _ := v.(map[string]any)
+				return inRange(fieldValue(source, field), bounds), 0, nil
+			}
+		default:
+			return false, 0, fmt.Errorf("memory backend does not support query [%s]", kind)
+		}
+	}
+
+	return false, 0, nil
+}
+
+func evalBool(clause map[string]any, source map[string]any) (bool, float64, error) {
+	score := 0.0
+
+	for _, key := range []string{"must", "filter"} {
+		for _, item := range toClauses(clause[key]) {
+			matched, s, err := evalQuery(item, source)
+			if err != nil {
+				return false, 0, err
+			}
+			if !matched {
+				return false, 0, nil
+			}
+			if key == "must" {
+				score += s
+			}
+		}
+	}
+
+	for _, item := range toClauses(clause["must_not"]) {
+		matched, _, err := evalQuery(item, source)
+		if err != nil {
+			return false, 0, err
+		}
+		if matched {
+			return false, 0, nil
+		}
+	}
+
+	should := toClauses(clause["should"])
+	if len(should) == 0 {
+		return true, score, nil
+	}
+
+	minimum := 0
+	if len(toClauses(clause["must"])) == 0 && len(toClauses(clause["filter"])) == 0 {
+		minimum = 1
+	}
+	if v, ok := clause["minimum_should_match"]; ok {
+		minimum = cast.ToInt(v)
+	}
+
+	count := 0
+	for _, item := range should {
+		matched, s, err := evalQuery(item, source)
+		if err != nil {
+			return false, 0, err
+		}
+		if matched {
+			count++
+			score += s
+		}
+	}
+
+	if boost, ok := clause["boost"]; ok {
+		score *= cast.ToFloat64(boost)
+	}
+
+	return count >= minimum, score, nil
+}
+
+// evalFunctionScore 支持 field_value_factor 和数值 origin 的 gauss，score_mode 只支持 sum
+func evalFunctionScore(clause map[string]any, source map[string]any) (bool, float64, error) {
+	inner, _ := clause["query"].(map[string]any)
+
+	matched, score, err := evalQuery(inner, source)
+	if err != nil || !matched {
+		return matched, 0, err
+	}
+
+	total := 0.0
+	for _, function := range toClauses(clause["functions"]) {
+		if filter, ok := function["filter"].(map[string]any); ok {
+			if hit, _, err := evalQuery(filter, source); err != nil || !hit {
+				continue
+			}
+		}
+
+		value := 0.0
+		if fvf, ok := function["field_value_factor"].(map[string]any); ok {
+			v := cast.ToFloat64(fieldValue(source, cast.ToString(fvf["field"])))
+			if factor, ok := fvf["factor"]; ok {
+				v *= cast.ToFloat64(factor)
+			}
+			switch cast.ToString(fvf["modifier"]) {
+			case "log1p":
+				v = math.Log10(1 + v)
+			case "ln1p":
+				v = math.Log1p(v)
+			case "sqrt":
+				v = math.Sqrt(v)
+			}
+			value = v
+		}
+		if gauss, ok := function["gauss"].(map[string]any); ok {
+			for field, raw := range gauss {
+				options, _ := raw.(map[string]any)
+				scale := memoryScale(options["scale"])
+				decay := 0.5
+				if v, ok := options["decay"]; ok {
+					decay = cast.ToFloat64(v)
+				}
+				if scale <= 0 {
+					continue
+				}
+				distance := math.Abs(cast.ToFloat64(fieldValue(source, field)) - cast.ToFloat64(options["origin"]))
+				sigma := -scale * scale / (2 * math.Log(decay))
+				value = math.Exp(-distance * distance / (2 * sigma))
+			}
+		}
+
+		weight := 1.0
+		if v, ok := function["weight"]; ok {
+			weight = cast.ToFloat64(v)
+		}
+		total += value * weight
+	}
+
+	if cast.ToString(clause["boost_mode"]) == "sum" {
+		return true, score + total, nil
+	}
+
+	return true, score * total, nil
+}
+
+// memoryScale 把 30d、12h 这样的时长换算成毫秒，纯数字原样返回
+func memoryScale(v any) float64 {
+	text := cast.ToString(v)
+	if f, err := cast.ToFloat64E(text); err == nil {
+		return f
+	}
+
+	units := map[string]float64{"d": 86400000, "h": 3600000, "m": 60000, "s": 1000}
+	for unit, ms := range units {
+		if strings.HasSuffix(text, unit) {
+			return cast.ToFloat64(strings.TrimSuffix(text, unit)) * ms
+		}
+	}
+
+	return 0
+}
+
+// toSlice 将任意切片转为 []any，cast.ToSlice 不支持 []float64 这类切片
+func toSlice(v any) []any {
+	if v == nil {
+		return []any{}
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return []any{v}
+	}
+
+	list := make([]any, 0, rv.Len())
+	for i := 0; i < rv.Len(); i++ {
+		list = append(list, rv.Index(i).Interface())
+	}
+
+	return list
+}
+
+func toClauses(v any) []map[string]any {
+	switch value := v.(type) {
+	case map[string]any:
+		return []map[string]any{value}
+	case []map[string]any:
+		return value
+	case []any:
+		list := make([]map[string]any, 0, len(value))
+		for _, item := range value {
+			if m, ok := item.(map[string]any); ok {
+				list = append(list, m)
+			}
+		}
+		return list
+	}
+
+	return []map[string]any{}
+}
+
+// fieldValue 取字段值，content.keyword 这样的子字段回退到父字段
+func fieldValue(source map[string]any, field string) any {
+	if v, ok := source[field]; ok {
+		return v
+	}
+
+	if idx := strings.LastIndex(field, "."); idx > 0 {
+		return fieldValue(source, field[:idx])
+	}
+
+	return nil
+}
+
+func matchText(phrase bool, text string, value any) float64 {
+	if value == nil {
+		return 0
+	}
+
+	content := strings.ToLower(cast.ToString(value))
+
+	if phrase {
+		if strings.Contains(content, strings.ToLower(text)) {
+			return 1
+		}
+		return 0
+	}
+
+	tokens := make(map[string]struct{})
+	for _, token := range memoryTokenize(content) {
+		tokens[token] = struct{}{}
+	}
+
+	score := 0.0
+	for _, token := range memoryTokenize(text) {
+		if _, ok := tokens[token]; ok {
+			score++
+		}
+	}
+
+	return score
+}
+
+// multiFieldValue content.en 这样的子字段不在 source 中，按 multi-fields 取父字段的值
+func multiFieldValue(source map[string]any, field string) any {
+	if value := fieldValue(source, field); value != nil {
+		return value
+	}
+
+	if parent, _, ok := strings.Cut(field, "."); ok {
+		return fieldValue(source, parent)
+	}
+
+	return nil
+}
+
+func equalValue(a, b any) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	if fa, err := cast.ToFloat64E(a); err == nil {
+		if fb, err := cast.ToFloat64E(b); err == nil {
+			return fa == fb
+		}
+	}
+
+	return cast.ToString(a) == cast.ToString(b)
+}
+
+func inRange(value any, bounds map[string]any) bool {
+	if value == nil {
+		return false
+	}
+
+	for op, bound := range bounds {
+		c := compareValue(value, bound)
+		switch op {
+		case "gt":
+			if c <= 0 {
+				return false
+			}
+		case "gte":
+			if c < 0 {
+				return false
+			}
+		case "lt":
+			if c >= 0 {
+				return false
+			}
+		case "lte":
+			if c > 0 {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func compareValue(a, b any) int {
+	fa, ea := cast.ToFloat64E(a)
+	fb, eb := cast.ToFloat64E(b)
+	if ea == nil && eb == nil {
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	}
+
+	return strings.Compare(cast.ToString(a), cast.ToString(b))
+}
+
+type sortSpec struct {
+	field string
+	desc  bool
+}
+
+func parseSortSpecs(v any) []sortSpec {
+	specs := make([]sortSpec, 0)
+
+	for _, item := range toSlice(v) {
+		switch value := item.(type) {
+		case string:
+			specs = append(specs, sortSpec{field: value, desc: value == "_score"})
+		case map[string]any:
+			for field, option := range value {
+				order := cast.ToString(option)
+				if m, ok := option.(map[string]any); ok {
+					order = cast.ToString(m["order"])
+				}
+				specs = append(specs, sortSpec{field: field, desc: order == "desc" || (order == "" && field == "_score")})
+			}
+		}
+	}
+
+	if len(specs) == 0 {
+		specs = append(specs, sortSpec{field: "_score", desc: true})
+	}
+
+	return specs
+}
+
+func (ss sortSpec) value(hit *memoryHit) any {
+	switch ss.field {
+	case "_score":
+		return hit.score
+	case "_shard_doc", "_doc":
+		return float64(hit.doc.seq)
+	}
+
+	v := fieldValue(hit.doc.source, ss.field)
+	if f, err := cast.ToFloat64E(v); err == nil {
+		return f
+	}
+	if v == nil {
+		return float64(0)
+	}
+
+	return cast.ToString(v)
+}
+
+func compareSort(specs []sortSpec, a, b []any) int {
+	for i, spec := range specs {
+		if i >= len(a) || i >= len(b) {
+			break
+		}
+		c := compareValue(a[i], b[i])
+		if spec.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+
+	return 0
+}
+
+// collectTerms 收集查询中用于高亮的词
+func collectTerms(query map[string]any) []string {
+	terms := make([]string, 0)
+
+	for kind, raw := range query {
+		clause, _ := raw.(map[string]any)
+
+		switch kind {
+		case "bool":
+			for _, key := range []string{"must", "should"} {
+				for _, item := range toClauses(clause[key]) {
+					terms = append(terms, collectTerms(item)...)
+				}
+			}
+		case "function_score":
+			inner, _ := clause["query"].(map[string]any)
+			terms = append(terms, collectTerms(inner)...)
+		case "match", "match_phrase":
+			for _, v := range clause {
+				text := cast.ToString(v)
+				if m, ok := v.(map[string]any); ok {
+					text = cast.ToString(m["query"])
+				}
+				if kind == "match_phrase" {
+					terms = append(terms, text)
+				} else {
+					terms = append(terms, memoryTokenize(text)...)
+				}
+			}
+		case "multi_match":
+			terms = append(terms, memoryTokenize(cast.ToString(clause["query"]))...)
+		}
+	}
+
+	return terms
+}
+
+func highlightDoc(highlight map[string]any, source map[string]any, terms []string) map[string]any {
+	pre, post := "<em>", "</em>"
+	if v := cast.ToStringSlice(highlight["pre_tags"]); len(v) > 0 {
+		pre = v[0]
+	}
+	if v := cast.ToStringSlice(highlight["post_tags"]); len(v) > 0 {
+		post = v[0]
+	}
+
+	result := make(map[string]any)
+
+	fields, _ := highlight["fields"].(map[string]any)
+	for field := range fields {
+		content := cast.ToString(fieldValue(source, field))
+		marked := content
+		for _, term := range terms {
+			if term == "" {
+				continue
+			}
+			marked = strings.ReplaceAll(marked, term, pre+term+post)
+		}
+		if marked != content {
+			result[field] = []string{marked}
+		}
+	}
+
+	return result
+}
+
+// memoryTokenize 近似 ik_smart：拉丁字符按词切分并转小写，中日韩字符按二元切分
+func memoryTokenize(text string) []string {
+	tokens := make([]string, 0)
+
+	word := make([]rune, 0)
+	han := make([]rune, 0)
+
+	flushWord := func() {
+		if len(word) > 0 {
+			tokens = append(tokens, strings.ToLower(string(word)))
+			word = word[:0]
+		}
+	}
+	flushHan := func() {
+		if len(han) == 1 {
+			tokens = append(tokens, string(han))
+		}
+		for i := 0; i+1 < len(han); i++ {
+			tokens = append(tokens, string(han[i:i+2]))
+		}
+		han = han[:0]
+	}
+
+	for _, r := range text {
+		switch {
+		case unicode.Is(unicode.Han, r):
+			flushWord()
+			han = append(han, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			flushHan()
+			word = append(word, r)
+		default:
+			flushWord()
+			flushHan()
+		}
+	}
+	flushWord()
+	flushHan()
+
+	return tokens
+}
+
+var _ Backend = (*MemoryBackend)(nil)
@@ -0,0 +1,305 @@
+package search
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// setupMemory 换成内存后端并写入 n 条包含“电影”的消息和一条不相关的消息，n 为 0 时不写入，测试结束后恢复
+func setupMemory(t *testing.T, n int) *MemoryBackend {
+	t.Helper()
+
+	backend, pms := _backend, _pms
+	t.Cleanup(func() {
+		SetBackend(backend)
+		_pms = pms
+	})
+
+	mb := NewMemoryBackend()
+	SetBackend(mb)
+	_pms = map[string]PITManager{}
+
+	for i := 0; i < n; i++ {
+		mb.Put(IndexMessage, fmt.Sprintf("%d", i), map[string]any{
+			"id":        i,
+			"content":   fmt.Sprintf("电影 第%d集", i),
+			"link":      fmt.Sprintf("/movies/%d", i),
+			"score":     i,
+			"videos":    i % 2,
+			"photos":    0,
+			"voices":    0,
+			"files":     0,
+			"posted_at": time.Now().Add(-time.Hour * time.Duration(i)).UnixMilli(),
+		})
+	}
+	if n > 0 {
+		mb.Put(IndexMessage, "ad", map[string]any{"id": n, "content": "广告", "link": "/ads/1"})
+	}
+
+	return mb
+}
+
+// usePIT 为 index 装上一个已经打开 pit 的管理器，不启动轮换协程
+func usePIT(t *testing.T, index string) *pitManager {
+	t.Helper()
+
+	pm := newPITManager(index, 2, time.Minute*time.Duration(2), time.Minute)
+	if err := pm.rotate(); err != nil {
+		t.Fatalf("rotate pits of %s error : %s", index, err.Error())
+	}
+	_pms[index] = pm
+
+	return pm
+}
+
+func TestMemorySearchPages(t *testing.T) {
+	setupMemory(t, 15)
+	usePIT(t, IndexMessage)
+
+	first, err := Search(0, "电影", nil, Options{Profile: ProfilePopular})
+	if err != nil {
+		t.Fatalf("search error : %s", err.Error())
+	}
+	if first.Degraded || len(first.Content) != 10 || !first.Next {
+		t.Fatalf("first page = degraded %v, %d items, next %v", first.Degraded, len(first.Content), first.Next)
+	}
+
+	second, err := Search(0, "电影", first.LastSort, Options{Profile: ProfilePopular})
+	if err != nil {
+		t.Fatalf("search error : %s", err.Error())
+	}
+	if second.Degraded || len(second.Content) != 5 {
+		t.Fatalf("second page = degraded %v, %d items", second.Degraded, len(second.Content))
+	}
+
+	seen := make(map[string]struct{})
+	for _, item := range append(first.Content, second.Content...) {
+		if _, exist := seen[item.Link]; exist {
+			t.Fatalf("%s returned twice", item.Link)
+		}
+		seen[item.Link] = struct{}{}
+	}
+	if _, exist := seen["https://t.me/ads/1"]; exist {
+		t.Fatalf("unmatched document returned")
+	}
+}
+
+func TestMemorySearchOrigin(t *testing.T) {
+	setupMemory(t, 15)
+	usePIT(t, IndexMessage)
+
+	before := time.Now().Truncate(time.Hour).UnixMilli()
+	first, err := Search(0, "电影", nil, Options{Profile: ProfileRelevance})
+	if err != nil {
+		t.Fatalf("search error : %s", err.Error())
+	}
+	after := time.Now().Truncate(time.Hour).UnixMilli()
+
+	// 查询期间可能跨过整点，取游标里实际的值
+	last, _ := first.LastSort[len(first.LastSort)-1].(map[string]any)
+	origin, _ := last["origin"].(int64)
+	if origin != before && origin != after {
+		t.Fatalf("cursor ends with %v, want origin %d or %d", last, before, after)
+	}
+
+	// 首页在上一个小时查询，游标经过 redis 保存后数字变成 float64
+	origin -= time.Hour.Milliseconds()
+	cursor := append(append([]any{}, first.LastSort[:len(first.LastSort)-1]...), map[string]any{"origin": float64(origin)})
+
+	second, err := Search(0, "电影", cursor, Options{Profile: ProfileRelevance})
+	if err != nil {
+		t.Fatalf("search error : %s", err.Error())
+	}
+	if second.Degraded || len(second.Content) != 5 {
+		t.Fatalf("second page = degraded %v, %d items", second.Degraded, len(second.Content))
+	}
+	if last := fmt.Sprint(second.LastSort[len(second.LastSort)-1]); last != fmt.Sprint(map[string]any{"origin": origin}) {
+		t.Fatalf("cursor ends with %s, want origin %d", last, origin)
+	}
+}
+
+func TestMemorySearchExcluded(t *testing.T) {
+	setupMemory(t, 3)
+
+	response, err := Search(0, "-第1集", nil, Options{})
+	if err != nil {
+		t.Fatalf("search error : %s", err.Error())
+	}
+
+	for _, item := range response.Content {
+		if item.Link == "https://t.me/movies/1" {
+			t.Fatalf("excluded document returned")
+		}
+	}
+	if len(response.Content) != 3 {
+		t.Fatalf("got %d items, want 3", len(response.Content))
+	}
+}
+
+func TestMemoryPITRotation(t *testing.T) {
+	mb := setupMemory(t, 1)
+	pm := usePIT(t, IndexMessage)
+
+	before := pm.Get()
+	if before == "" || pm.Stats().Open != 2 {
+		t.Fatalf("pool not filled : %+v", pm.Stats())
+	}
+
+	if err := pm.rotate(); err != nil {
+		t.Fatalf("rotate error : %s", err.Error())
+	}
+
+	// 旧的 pit 在延迟关闭之前仍然可用
+	if len(mb.pits) != 4 {
+		t.Fatalf("%d pits open after rotation, want 4", len(mb.pits))
+	}
+
+	pm.closeLast()
+
+	if _, exist := mb.pits[before]; exist || len(mb.pits) != 2 {
+		t.Fatalf("old pits not closed : %+v", mb.pits)
+	}
+
+	for i := 0; i < 4; i++ {
+		if pid := pm.Get(); pid == before || mb.pits[pid] == "" {
+			t.Fatalf("got closed pit %s", pid)
+		}
+	}
+}
+
+func TestPITRotationClamp(t *testing.T) {
+	setupMemory(t, 0)
+
+	// 轮换比延迟关闭还短时，旧 pit 永远等不到关闭
+	pm := newPITManager(IndexMessage, 2, time.Second, time.Second*time.Duration(5))
+	if pm.Rotation() != _pitCloseGrace {
+		t.Fatalf("rotation %s, want %s", pm.Rotation(), _pitCloseGrace)
+	}
+
+	if pm.keepAlive != _pitCloseGrace*2 {
+		t.Fatalf("keep alive %s, want %s", pm.keepAlive, _pitCloseGrace*2)
+	}
+}
+
+func TestMemoryPITRotationFailure(t *testing.T) {
+	setupMemory(t, 0)
+
+	pm := newPITManager("missing", 2, time.Minute*time.Duration(2), time.Minute)
+	if err := pm.rotate(); err == nil {
+		t.Fatalf("rotate on a missing index succeeded")
+	}
+
+	if stats := pm.Stats(); stats.Open != 0 || stats.Failures != 1 || stats.LastError == "" {
+		t.Fatalf("unexpected stats : %+v", stats)
+	}
+}
+
+func TestMemorySearchDegrade(t *testing.T) {
+	mb := setupMemory(t, 12)
+
+	// 没有 pit
+	response, err := Search(0, "电影", nil, Options{Profile: ProfilePopular})
+	if err != nil {
+		t.Fatalf("search error : %s", err.Error())
+	}
+	if !response.Degraded || len(response.Content) != 10 {
+		t.Fatalf("no pit = degraded %v, %d items", response.Degraded, len(response.Content))
+	}
+
+	// pit 过期
+	pm := usePIT(t, IndexMessage)
+	for _, pid := range pm.current {
+		delete(mb.pits, pid)
+	}
+
+	response, err = Search(0, "电影", nil, Options{Profile: ProfilePopular})
+	if err != nil {
+		t.Fatalf("search error : %s", err.Error())
+	}
+	if !response.Degraded || len(response.Content) != 10 {
+		t.Fatalf("expired pit = degraded %v, %d items", response.Degraded, len(response.Content))
+	}
+
+	// 降级查询的游标继续翻页
+	next, err := Search(0, "电影", response.LastSort, Options{Profile: ProfilePopular})
+	if err != nil {
+		t.Fatalf("search error : %s", err.Error())
+	}
+	if !next.Degraded || len(next.Content) != 2 {
+		t.Fatalf("next page = degraded %v, %d items", next.Degraded, len(next.Content))
+	}
+
+	// pit 恢复后降级查询的游标不能用在 pit 上，继续直接查索引
+	if err = pm.rotate(); err != nil {
+		t.Fatalf("rotate error : %s", err.Error())
+	}
+	next, err = Search(0, "电影", response.LastSort, Options{Profile: ProfilePopular})
+	if err != nil {
+		t.Fatalf("search error : %s", err.Error())
+	}
+	if !next.Degraded || len(next.Content) != 2 {
+		t.Fatalf("next page after pit recovered = degraded %v, %d items", next.Degraded, len(next.Content))
+	}
+
+	// pit 的游标在 pit 过期后去掉 _shard_doc 继续翻页
+	first, err := Search(0, "电影", nil, Options{Profile: ProfilePopular})
+	if err != nil {
+		t.Fatalf("search error : %s", err.Error())
+	}
+	if first.Degraded {
+		t.Fatalf("first page degraded with pit available")
+	}
+	for _, pid := range pm.current {
+		delete(mb.pits, pid)
+	}
+	next, err = Search(0, "电影", first.LastSort, Options{Profile: ProfilePopular})
+	if err != nil {
+		t.Fatalf("search error : %s", err.Error())
+	}
+	if !next.Degraded || len(next.Content) != 2 {
+		t.Fatalf("next page after pit expired = degraded %v, %d items", next.Degraded, len(next.Content))
+	}
+}
+
+func TestMemorySearchUnsupportedFilters(t *testing.T) {
+	setupMemory(t, 3)
+
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"type:video min_members:100 电影", []string{"min_members:100"}},
+		{"type:bot min_members:1 min_messages:5 电影", []string{"min_members:1", "min_messages:5"}},
+	}
+
+	for _, tt := range tests {
+		_, err := Search(0, tt.text, nil, Options{})
+
+		oe := new(OperatorError)
+		if !errors.As(err, &oe) || !reflect.DeepEqual(oe.Operators, tt.want) {
+			t.Fatalf("search %q error = %v, want operators %v", tt.text, err, tt.want)
+		}
+	}
+}
+
+func TestMemorySearchBot(t *testing.T) {
+	mb := setupMemory(t, 0)
+	t.Cleanup(func() { SetBlocklist(nil) })
+
+	mb.Put(IndexBot, "1", map[string]any{"id": "1", "username": "movie_bot", "description": "电影 机器人", "category": "影视", "score": 3})
+	mb.Put(IndexBot, "2", map[string]any{"id": "2", "username": "ads_bot", "description": "电影 广告", "category": "影视", "score": 2})
+	mb.Put(IndexBot, "3", map[string]any{"id": "3", "username": "hidden_bot", "description": "电影 机器人", "category": "影视", "score": 1})
+
+	SetBlocklist([]BlockEntry{{Index: IndexBot, Field: BlockFieldID, Value: "3"}})
+
+	response, err := Search(SearchTypeBot, "电影 -广告", nil, Options{})
+	if err != nil {
+		t.Fatalf("search error : %s", err.Error())
+	}
+	if len(response.Content) != 1 || response.Content[0].Link != "https://t.me/movie_bot" {
+		t.Fatalf("got %+v, want only movie_bot", response.Content)
+	}
+}
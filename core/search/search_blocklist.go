@@ -0,0 +1,155 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BlockFieldLink = "link"
+	BlockFieldID   = "id"
+)
+
+var (
+	_bLocker   = new(sync.RWMutex)
+	_blocklist = map[string]map[string][]string{} // index -> field -> values
+)
+
+// BlockEntry Index 为 message、cog 或 bot，bot 只能按 id
+type BlockEntry struct {
+	Index string
+	Field string
+	Value string
+}
+
+// SetBlocklist 整体替换屏蔽列表，查询时作为 must_not 过滤
+func SetBlocklist(entries []BlockEntry) {
+	m := make(map[string]map[string][]string)
+	for _, entry := range entries {
+		fields, exist := m[entry.Index]
+		if !exist {
+			fields = make(map[string][]string)
+			m[entry.Index] = fields
+		}
+		fields[entry.Field] = append(fields[entry.Field], entry.Value)
+	}
+
+	_bLocker.Lock()
+	_blocklist = m
+	_bLocker.Unlock()
+
+	// 下架和恢复都会改变屏蔽列表，所有实例重新加载后缓存的 key 随之改变
+	values := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		values = append(values, fmt.Sprintf("%s:%s:%s", entry.Index, entry.Field, entry.Value))
+	}
+	_cache.version("blocklist", fingerprint(values))
+}
+
+// blockFilter 返回 index 对应的 must_not 条件
+func blockFilter(index string) []any {
+	_bLocker.RLock()
+	defer _bLocker.RUnlock()
+
+	fields := _blocklist[index]
+
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+
+	filter := make([]any, 0, len(names))
+	for _, field := range names {
+		filter = append(filter, map[string]any{"terms": map[string]any{field: fields[field]}})
+	}
+
+	return filter
+}
+
+// NormalizeLink 去掉 https://t.me 前缀，和索引里存的 link 保持一致
+func NormalizeLink(link string) string {
+	link = strings.TrimSpace(link)
+	for _, prefix := range []string{"https://", "http://"} {
+		link = strings.TrimPrefix(link, prefix)
+	}
+	link = strings.TrimPrefix(link, "t.me")
+
+	if link != "" && !strings.HasPrefix(link, "/") {
+		link = "/" + link
+	}
+
+	return link
+}
+
+var (
+	_cogLink     = regexp.MustCompile(`^/[A-Za-z0-9_]+$`)
+	_messageLink = regexp.MustCompile(`^/[A-Za-z0-9_]+/[0-9]+$`)
+)
+
+// documentLink 写入前规范化文档的 link，只接受 t.me 的链接或 /name、/name/id，message 必须带 id
+// 结果按 https://t.me%s 展示，下架和 link: 也按规范化后的值比较，其他形式的链接写进去之后无法下架
+func documentLink(link string, message bool) (string, error) {
+	link = strings.TrimSpace(link)
+	for _, prefix := range []string{"https://", "http://"} {
+		if rest, ok := strings.CutPrefix(link, prefix); ok && !strings.HasPrefix(rest, "t.me/") {
+			return "", errors.New(fmt.Sprintf("link [%s] is not a t.me link", link))
+		}
+	}
+
+	normalized, pattern, shape := NormalizeLink(link), _cogLink, "https://t.me/name"
+	if message {
+		pattern, shape = _messageLink, "https://t.me/name/id"
+	}
+	if !pattern.MatchString(normalized) {
+		return "", errors.New(fmt.Sprintf("link [%s] must be like %s", link, shape))
+	}
+
+	return normalized, nil
+}
+
+// DeleteDocuments 删除 index（message 或 cog）中 field 等于 value 的文档，返回删除条数
+func DeleteDocuments(index, field, value string) (uint64, error) {
+	target := ""
+	switch index {
+	case SeriesMessage:
+		target = IndexMessage
+	case IndexCog, IndexBot:
+		target = index
+	default:
+		return 0, errors.New(fmt.Sprintf("unsupported index [%s]", index))
+	}
+
+	// 机器人没有 link
+	if (field != BlockFieldLink && field != BlockFieldID) || (index == IndexBot && field != BlockFieldID) {
+		return 0, errors.New(fmt.Sprintf("unsupported field [%s] of [%s]", field, index))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(60))
+	defer cancel()
+
+	return _backend.DeleteByQuery(ctx, target, map[string]any{"term": map[string]any{field: value}})
+}
+
+// blocked 文档是否在屏蔽列表中，用于无法加 must_not 的查询，如 completion suggester
+func blocked(index string, source map[string]any) bool {
+	_bLocker.RLock()
+	defer _bLocker.RUnlock()
+
+	for field, values := range _blocklist[index] {
+		value := fmt.Sprint(source[field])
+		for _, item := range values {
+			if item == value {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,426 @@
+package search
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"jarvis/dao/db/redis"
+	"jarvis/logger"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bytedance/sonic"
+	ORedis "github.com/redis/go-redis/v9"
+)
+
+var (
+	_cache = newResultCache(CacheConfig{})
+)
+
+// CacheConfig 查询结果缓存，进程内 LRU 在前，redis 在后供多个实例共享
+type CacheConfig struct {
+	Size  int           // 进程内缓存的条数，0 不缓存
+	TTL   time.Duration // 实际取值不超过对应索引 pit 的轮换间隔
+	Redis bool          // 是否使用 redis 二级缓存
+}
+
+type CacheStats struct {
+	Size        int    `json:"size"`
+	Hits        uint64 `json:"hits"`
+	RedisHits   uint64 `json:"redis_hits"`
+	Misses      uint64 `json:"misses"`
+	Stored      uint64 `json:"stored"`
+	Evicted     uint64 `json:"evicted"`
+	Invalidated uint64 `json:"invalidated"`
+	Errors      uint64 `json:"errors"`
+}
+
+type cacheEntry struct {
+	Key      string         `json:"key"`
+	Response SearchResponse `json:"response"`
+	Links    []string       `json:"links"`
+	Expire   int64          `json:"expire"` // 毫秒
+}
+
+type resultCache struct {
+	config   CacheConfig
+	mutex    *sync.Mutex
+	lru      *list.List
+	entries  map[string]*list.Element
+	links    map[string]map[string]struct{} // link -> keys，下架或更新时按 link 失效
+	versions map[string]string              // 屏蔽列表、同义词等影响结果的数据的指纹，参与计算 key
+	stats    CacheStats
+}
+
+func newResultCache(config CacheConfig) *resultCache {
+	rc := &resultCache{
+		mutex:    new(sync.Mutex),
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		links:    make(map[string]map[string]struct{}),
+		versions: make(map[string]string),
+	}
+	rc.configure(config)
+
+	return rc
+}
+
+// configure Init 时调用，保留 LoadCache 阶段已经设置的指纹
+func (rc *resultCache) configure(config CacheConfig) {
+	if config.TTL <= 0 {
+		config.TTL = time.Minute
+	}
+
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	rc.config = config
+}
+
+func (rc *resultCache) enabled() bool {
+	return rc.config.Size > 0
+}
+
+// key 解析后相同的输入、类型、排序方式、游标和选项得到同一个 key
+func (rc *resultCache) key(t uint8, text string, sort []any, options Options) string {
+	profile := options.Profile
+	if pc, exist := Profile(profile); exist {
+		profile = pc.Name
+	}
+
+	rc.mutex.Lock()
+	versions := make(map[string]string, len(rc.versions))
+	for name, version := range rc.versions {
+		versions[name] = version
+	}
+	rc.mutex.Unlock()
+
+	// ConfigStd 按 key 排序，同样的内容序列化结果相同
+	data, _ := sonic.ConfigStd.Marshal(map[string]any{
+		"type":        t,
+		"query":       queryKey(ParseQuery(text)),
+		"sort":        sort,
+		"profile":     profile,
+		"nsfw":        options.NSFW,
+		"language":    normalizeLanguage(options.Language),
+		"posted_from": options.PostedFrom,
+		"posted_to":   options.PostedTo,
+		"versions":    versions,
+	})
+
+	sum := sha1.Sum(data)
+
+	return fmt.Sprintf("SearchResult:%s", hex.EncodeToString(sum[:]))
+}
+
+// queryKey 按解析结果计算，OR 只有大写才是操作符，不能先转小写再解析，词本身和分词器一样忽略大小写
+func queryKey(query Query) map[string]any {
+	lower := func(terms []Term) []Term {
+		list := make([]Term, 0, len(terms))
+		for _, term := range terms {
+			list = append(list, Term{Text: strings.ToLower(term.Text), Phrase: term.Phrase})
+		}
+		return list
+	}
+
+	terms := make([]string, 0, len(query.Terms))
+	for _, term := range query.Terms {
+		terms = append(terms, strings.ToLower(term))
+	}
+
+	anys := make([][]Term, 0, len(query.Any))
+	for _, group := range query.Any {
+		anys = append(anys, lower(group))
+	}
+
+	filters := map[string]any{
+		"link":         query.Filters.Link,
+		"min_members":  query.Filters.MinMembers,
+		"min_messages": query.Filters.MinMessages,
+	}
+	if query.Filters.Type != nil {
+		filters["type"] = *(query.Filters.Type)
+	}
+
+	return map[string]any{
+		"terms":    terms,
+		"required": lower(query.Required),
+		"excluded": lower(query.Excluded),
+		"any":      anys,
+		"filters":  filters,
+		"unknown":  query.Unknown,
+		// 机器人搜索和纠错直接用去掉操作符后的原文
+		"text": strings.ToLower(query.Text),
+	}
+}
+
+// ttl pit 轮换之后新写入和更新的文档才可见，缓存不能比这更久
+func (rc *resultCache) ttl(t uint8) time.Duration {
+	index := IndexMessage
+	switch t {
+	case CogTypeGroup, CogTypeChannel:
+		index = IndexCog
+	case SearchTypeBot:
+		index = IndexBot
+	}
+
+	ttl := rc.config.TTL
+	if pm, exist := _pms[index]; exist {
+		ttl = min(ttl, pm.Rotation())
+	}
+
+	return ttl
+}
+
+func (rc *resultCache) get(key string) (*SearchResponse, bool) {
+	if !rc.enabled() {
+		return nil, false
+	}
+
+	now := time.Now().UnixMilli()
+
+	rc.mutex.Lock()
+	if element, exist := rc.entries[key]; exist {
+		entry := element.Value.(*cacheEntry)
+		if entry.Expire > now {
+			rc.lru.MoveToFront(element)
+			rc.stats.Hits++
+			rc.mutex.Unlock()
+
+			return entry.Response.clone(), true
+		}
+		rc.remove(element)
+	}
+	rc.mutex.Unlock()
+
+	if !rc.config.Redis {
+		rc.miss()
+		return nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*time.Duration(500))
+	defer cancel()
+
+	data, err := redis.Instance().Get(ctx, key).Bytes()
+	if err != nil {
+		if !errors.Is(err, ORedis.Nil) {
+			rc.fail()
+			logger.App().Errorf("get %s error : %s", key, err.Error())
+		}
+		rc.miss()
+		return nil, false
+	}
+
+	entry := new(cacheEntry)
+	if err = sonic.Unmarshal(data, entry); err != nil || entry.Expire <= now {
+		rc.miss()
+		return nil, false
+	}
+
+	rc.mutex.Lock()
+	rc.stats.RedisHits++
+	rc.insert(entry)
+	rc.mutex.Unlock()
+
+	return entry.Response.clone(), true
+}
+
+// put 降级查询的结果不缓存
+func (rc *resultCache) put(key string, response *SearchResponse) {
+	if !rc.enabled() || response.Degraded {
+		return
+	}
+
+	ttl := rc.ttl(response.Type)
+
+	entry := &cacheEntry{
+		Key:      key,
+		Response: *(response.clone()),
+		Links:    make([]string, 0, len(response.Content)),
+		Expire:   time.Now().Add(ttl).UnixMilli(),
+	}
+	for _, item := range response.Content {
+		entry.Links = append(entry.Links, NormalizeLink(item.Link))
+	}
+
+	rc.mutex.Lock()
+	rc.stats.Stored++
+	rc.insert(entry)
+	rc.mutex.Unlock()
+
+	if !rc.config.Redis {
+		return
+	}
+
+	data, err := sonic.Marshal(entry)
+	if err != nil {
+		logger.App().Errorf("marshal %s error : %s", key, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*time.Duration(500))
+	defer cancel()
+
+	pipe := redis.Instance().Pipeline()
+	pipe.Set(ctx, key, data, ttl)
+	for _, link := range entry.Links {
+		pipe.SAdd(ctx, cacheLinkKey(link), key)
+		pipe.Expire(ctx, cacheLinkKey(link), ttl)
+	}
+	if _, err = pipe.Exec(ctx); err != nil {
+		rc.fail()
+		logger.App().Errorf("set %s error : %s", key, err.Error())
+	}
+}
+
+// evict 只清理本实例的缓存，其他实例收到广播后各自清理
+func (rc *resultCache) evict(links ...string) int {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	evicted := 0
+	for _, link := range links {
+		for key := range rc.links[NormalizeLink(link)] {
+			if element, exist := rc.entries[key]; exist {
+				rc.remove(element)
+				evicted++
+			}
+		}
+	}
+	rc.stats.Invalidated += uint64(evicted)
+
+	return evicted
+}
+
+// invalidate 清理本实例和 redis 中包含这些 link 的结果
+func (rc *resultCache) invalidate(links ...string) {
+	if !rc.enabled() || len(links) == 0 {
+		return
+	}
+
+	rc.evict(links...)
+
+	if !rc.config.Redis {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	for _, link := range links {
+		lk := cacheLinkKey(NormalizeLink(link))
+		keys, err := redis.Instance().SMembers(ctx, lk).Result()
+		if err != nil {
+			rc.fail()
+			logger.App().Errorf("smembers %s error : %s", lk, err.Error())
+			continue
+		}
+		if err = redis.Instance().Del(ctx, append(keys, lk)...).Err(); err != nil {
+			rc.fail()
+			logger.App().Errorf("del %s error : %s", lk, err.Error())
+		}
+	}
+}
+
+// version 影响结果的数据变化后换掉指纹，redis 里的旧结果不会再被命中，等待过期
+func (rc *resultCache) version(name string, version string) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	if rc.versions[name] == version {
+		return
+	}
+	rc.versions[name] = version
+
+	rc.lru.Init()
+	rc.entries = make(map[string]*list.Element)
+	rc.links = make(map[string]map[string]struct{})
+}
+
+func (rc *resultCache) Stats() CacheStats {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	stats := rc.stats
+	stats.Size = rc.lru.Len()
+
+	return stats
+}
+
+// insert 调用方持有锁
+func (rc *resultCache) insert(entry *cacheEntry) {
+	if element, exist := rc.entries[entry.Key]; exist {
+		rc.remove(element)
+	}
+
+	rc.entries[entry.Key] = rc.lru.PushFront(entry)
+	for _, link := range entry.Links {
+		keys, exist := rc.links[link]
+		if !exist {
+			keys = make(map[string]struct{})
+			rc.links[link] = keys
+		}
+		keys[entry.Key] = struct{}{}
+	}
+
+	for rc.lru.Len() > rc.config.Size {
+		rc.remove(rc.lru.Back())
+		rc.stats.Evicted++
+	}
+}
+
+// remove 调用方持有锁
+func (rc *resultCache) remove(element *list.Element) {
+	entry := rc.lru.Remove(element).(*cacheEntry)
+	delete(rc.entries, entry.Key)
+
+	for _, link := range entry.Links {
+		if keys, exist := rc.links[link]; exist {
+			delete(keys, entry.Key)
+			if len(keys) == 0 {
+				delete(rc.links, link)
+			}
+		}
+	}
+}
+
+func (rc *resultCache) miss() {
+	rc.mutex.Lock()
+	rc.stats.Misses++
+	rc.mutex.Unlock()
+}
+
+func (rc *resultCache) fail() {
+	rc.mutex.Lock()
+	rc.stats.Errors++
+	rc.mutex.Unlock()
+}
+
+func cacheLinkKey(link string) string {
+	return fmt.Sprintf("SearchResultLink:%s", link)
+}
+
+// fingerprint 与顺序无关的指纹
+func fingerprint(values []string) string {
+	values = append([]string{}, values...)
+	sort.Strings(values)
+
+	sum := sha1.Sum([]byte(strings.Join(values, "\n")))
+
+	return hex.EncodeToString(sum[:8])
+}
+
+// InvalidateCache 文档更新或下架后清理包含这些 link 的缓存结果，link 可以带 https://t.me 前缀
+func InvalidateCache(links ...string) {
+	_cache.invalidate(links...)
+}
+
+// EvictCache 只清理本实例的缓存，用于处理其他实例广播的失效通知
+func EvictCache(links ...string) int {
+	return _cache.evict(links...)
+}
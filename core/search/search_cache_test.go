@@ -0,0 +1,49 @@
+package search
+
+import "testing"
+
+func TestCacheKey(t *testing.T) {
+	rc := newResultCache(CacheConfig{})
+
+	tests := []struct {
+		name string
+		a, b string
+		same bool
+	}{
+		{"case", "Movie 4K", "movie 4k", true},
+		{"spaces", " 电影   下载 ", "电影 下载", true},
+		{"or is case sensitive", "a OR b", "a or b", false},
+		{"phrase", `"a b"`, "a b", false},
+		{"excluded", "电影 -广告", "电影 广告", false},
+		{"operator", "type:video 电影", "电影", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := rc.key(0, tt.a, nil, Options{}), rc.key(0, tt.b, nil, Options{})
+			if (a == b) != tt.same {
+				t.Fatalf("key(%q) == key(%q) is %v, want %v", tt.a, tt.b, a == b, tt.same)
+			}
+		})
+	}
+}
+
+func TestCacheGetCopies(t *testing.T) {
+	rc := newResultCache(CacheConfig{Size: 10})
+
+	rc.put("key", &SearchResponse{
+		Content:     []SearchContent{{Link: "https://t.me/movies/1"}},
+		LastSort:    []any{1, map[string]any{"origin": 1}},
+		Suggestions: []string{"电影"},
+	})
+
+	first, _ := rc.get("key")
+	first.Content[0].Link = "changed"
+	first.LastSort[1].(map[string]any)["origin"] = 2
+	first.Suggestions[0] = "changed"
+
+	second, _ := rc.get("key")
+	if second.Content[0].Link != "https://t.me/movies/1" || second.LastSort[1].(map[string]any)["origin"] != 1 || second.Suggestions[0] != "电影" {
+		t.Fatalf("cached response modified through a previous result : %+v", *(second))
+	}
+}
@@ -0,0 +1,88 @@
+package search
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	_flight = newFlightGroup()
+
+	errFlightAborted = errors.New("coalesced search aborted")
+)
+
+// FlightStats Leaders 为实际执行的查询数，Shared 为等待并复用了其他请求结果的次数
+type FlightStats struct {
+	Leaders  uint64 `json:"leaders"`
+	Shared   uint64 `json:"shared"`
+	InFlight int    `json:"in_flight"`
+}
+
+type flightCall struct {
+	wg       sync.WaitGroup
+	response *SearchResponse
+	err      error
+}
+
+// flightGroup 相同 key 的查询同时只执行一次，其余请求等待并共享结果
+type flightGroup struct {
+	mutex *sync.Mutex
+	calls map[string]*flightCall
+	stats FlightStats
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{
+		mutex: new(sync.Mutex),
+		calls: make(map[string]*flightCall),
+	}
+}
+
+// do 返回值中的 shared 表示结果来自其他请求
+func (fg *flightGroup) do(key string, fn func() (*SearchResponse, error)) (*SearchResponse, error, bool) {
+	fg.mutex.Lock()
+	if call, exist := fg.calls[key]; exist {
+		fg.stats.Shared++
+		fg.mutex.Unlock()
+
+		call.wg.Wait()
+
+		if call.err != nil {
+			return nil, call.err, true
+		}
+
+		return call.response.clone(), nil, true
+	}
+
+	call := &flightCall{err: errFlightAborted}
+	call.wg.Add(1)
+	fg.calls[key] = call
+	fg.stats.Leaders++
+	fg.mutex.Unlock()
+
+	// fn panic 时等待的请求拿到 errFlightAborted，不会一直阻塞
+	defer func() {
+		fg.mutex.Lock()
+		delete(fg.calls, key)
+		fg.mutex.Unlock()
+
+		call.wg.Done()
+	}()
+
+	call.response, call.err = fn()
+	if call.err != nil {
+		return nil, call.err, false
+	}
+
+	return call.response.clone(), nil, false
+}
+
+func (fg *flightGroup) Stats() FlightStats {
+	fg.mutex.Lock()
+	defer fg.mutex.Unlock()
+
+	stats := fg.stats
+	stats.InFlight = len(fg.calls)
+
+	return stats
+}
@@ -0,0 +1,468 @@
+package search
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"jarvis/logger"
+	"sync"
+	"time"
+)
+
+var (
+	ErrIngestBusy = errors.New("ingest queue is full")
+
+	_indexer   = newBulkIndexer(IngestConfig{})
+	_onIndexed = func(links []string) {}
+)
+
+// OnIndexed 设置写入成功后的回调，参数为写入成功的文档的 link，本实例和 redis 的缓存已经清理过，需在 Start 之前调用
+func OnIndexed(fn func(links []string)) { _onIndexed = fn }
+
+type IngestConfig struct {
+	BatchSize  int
+	Interval   time.Duration // 不足一批时的最长等待
+	MaxRetries int
+	Queue      int
+}
+
+type IngestStats struct {
+	Queued  int    `json:"queued"`
+	Indexed uint64 `json:"indexed"`
+	Retried uint64 `json:"retried"`
+	Dropped uint64 `json:"dropped"`
+	Batches uint64 `json:"batches"`
+}
+
+// Rejected 未通过校验的文档
+type Rejected struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// MessageDocument 对应 message 的 mapping
+type MessageDocument struct {
+	ID       string `json:"id"`
+	Content  string `json:"content"`
+	Link     string `json:"link"`
+	Score    int    `json:"score"`
+	Photos   int    `json:"photos"`
+	Videos   int    `json:"videos"`
+	Voices   int    `json:"voices"`
+	Files    int    `json:"files"`
+	NSFW     bool   `json:"nsfw"`
+	PostedAt int64  `json:"posted_at"` // 毫秒，0 表示未知
+	Lang     string `json:"lang"`      // 为空时按内容检测
+}
+
+func (md MessageDocument) validate() error {
+	switch {
+	case md.ID == "":
+		return errors.New("id is required")
+	case md.Content == "":
+		return errors.New("content is required")
+	case md.Link == "":
+		return errors.New("link is required")
+	case md.Score < 0 || md.Photos < 0 || md.Videos < 0 || md.Voices < 0 || md.Files < 0:
+		return errors.New("score and media counts must not be negative")
+	case md.PostedAt < 0:
+		return errors.New("posted_at must not be negative")
+	}
+
+	_, err := documentLink(md.Link, true)
+
+	return err
+}
+
+func (md MessageDocument) source() map[string]any {
+	source := map[string]any{
+		"id":      md.ID,
+		"content": md.Content,
+		"link":    NormalizeLink(md.Link),
+		"score":   md.Score,
+		"photos":  md.Photos,
+		"videos":  md.Videos,
+		"voices":  md.Voices,
+		"files":   md.Files,
+		"nsfw":    md.NSFW,
+	}
+
+	if lang := languageOf(md.Lang, md.Content); lang != "" {
+		source["lang"] = lang
+	}
+
+	if md.PostedAt > 0 {
+		source["posted_at"] = md.PostedAt
+	}
+
+	// completion 不能按 nsfw 过滤，这类内容不参与补全
+	if !md.NSFW {
+		source["suggest"] = completionInput(firstLine(md.Content), md.Score)
+	}
+
+	return source
+}
+
+// CogDocument 对应 cog 的 mapping
+type CogDocument struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	Type     uint8  `json:"type"`
+	Link     string `json:"link"`
+	Members  int    `json:"members"`
+	Messages int    `json:"messages"`
+	NSFW     bool   `json:"nsfw"`
+	Lang     string `json:"lang"` // 为空时按标题检测
+}
+
+func (cd CogDocument) validate() error {
+	switch {
+	case cd.ID == "":
+		return errors.New("id is required")
+	case cd.Title == "":
+		return errors.New("title is required")
+	case cd.Link == "":
+		return errors.New("link is required")
+	case cd.Type != CogTypeGroup && cd.Type != CogTypeChannel:
+		return errors.New(fmt.Sprintf("type must be %d(group) or %d(channel)", CogTypeGroup, CogTypeChannel))
+	case cd.Members < 0 || cd.Messages < 0:
+		return errors.New("members and messages must not be negative")
+	}
+
+	_, err := documentLink(cd.Link, false)
+
+	return err
+}
+
+func (cd CogDocument) source() map[string]any {
+	source := map[string]any{
+		"id":       cd.ID,
+		"title":    cd.Title,
+		"type":     cd.Type,
+		"link":     NormalizeLink(cd.Link),
+		"members":  cd.Members,
+		"messages": cd.Messages,
+		"nsfw":     cd.NSFW,
+	}
+
+	if lang := languageOf(cd.Lang, cd.Title); lang != "" {
+		source["lang"] = lang
+	}
+
+	if !cd.NSFW {
+		source["suggest"] = completionInput(cd.Title, cd.Members)
+	}
+
+	return source
+}
+
+// DecodeDocuments 解析单个文档或文档数组，mapping 之外的字段直接报错
+func DecodeDocuments[T MessageDocument | CogDocument](data []byte) ([]T, error) {
+	data = bytes.TrimSpace(data)
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	if len(data) > 0 && data[0] == '[' {
+		docs := make([]T, 0)
+		if err := decoder.Decode(&docs); err != nil {
+			return nil, err
+		}
+		return docs, nil
+	}
+
+	doc := new(T)
+	if err := decoder.Decode(doc); err != nil {
+		return nil, err
+	}
+
+	return []T{*doc}, nil
+}
+
+// IngestMessages 校验后写入 message 的写别名，返回入队条数和被拒绝的文档，队列满时返回 ErrIngestBusy
+func IngestMessages(docs []MessageDocument) (int, []Rejected, error) {
+	items, rejected := make([]BulkItem, 0, len(docs)), make([]Rejected, 0)
+	for _, doc := range docs {
+		if err := doc.validate(); err != nil {
+			rejected = append(rejected, Rejected{ID: doc.ID, Reason: err.Error()})
+			continue
+		}
+		items = append(items, BulkItem{Index: AliasMessageWrite, ID: doc.ID, Source: doc.source()})
+	}
+
+	accepted, err := _indexer.add(items...)
+
+	return accepted, rejected, err
+}
+
+// IngestCogs 校验后写入 cog，返回值同 IngestMessages
+func IngestCogs(docs []CogDocument) (int, []Rejected, error) {
+	items, rejected := make([]BulkItem, 0, len(docs)), make([]Rejected, 0)
+	for _, doc := range docs {
+		if err := doc.validate(); err != nil {
+			rejected = append(rejected, Rejected{ID: doc.ID, Reason: err.Error()})
+			continue
+		}
+		items = append(items, BulkItem{Index: IndexCog, ID: doc.ID, Source: doc.source()})
+	}
+
+	accepted, err := _indexer.add(items...)
+
+	return accepted, rejected, err
+}
+
+// invalidateItems 已经缓存的结果中包含写入成功的文档时清理掉，新文档要等 pit 轮换才可见，不受影响
+func invalidateItems(items []BulkItem) {
+	if len(items) == 0 {
+		return
+	}
+
+	links := make([]string, 0, len(items))
+	for _, item := range items {
+		links = append(links, fmt.Sprint(item.Source["link"]))
+	}
+
+	_cache.invalidate(links...)
+	_onIndexed(links)
+}
+
+// locate 写到 message 写别名的文档已经存在于旧的滚动索引或旧的单索引时改为写回原索引，避免读别名下出现两份
+// 查询失败时照旧写到写别名
+func locate(items []BulkItem) {
+	ids := make([]string, 0, len(items))
+	for _, item := range items {
+		if item.Index == AliasMessageWrite {
+			ids = append(ids, item.ID)
+		}
+	}
+
+	if len(ids) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(10))
+	defer cancel()
+
+	data, err := _backend.Search(ctx, IndexMessage, map[string]any{
+		"size":             len(ids),
+		"_source":          []string{"id"},
+		"track_total_hits": false,
+		"query":            map[string]any{"terms": map[string]any{"id": ids}},
+	})
+	if err != nil {
+		logger.App().Errorf("locate %d items error : %s", len(ids), err.Error())
+		return
+	}
+
+	var result struct {
+		Hits struct {
+			Hits []struct {
+				Index string `json:"_index"`
+				ID    string `json:"_id"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err = json.Unmarshal(data, &result); err != nil {
+		logger.App().Errorf("locate %d items error : %s", len(ids), err.Error())
+		return
+	}
+
+	indices := make(map[string]string, len(result.Hits.Hits))
+	for _, hit := range result.Hits.Hits {
+		indices[hit.ID] = hit.Index
+	}
+
+	for i, item := range items {
+		if index, exist := indices[item.ID]; exist && item.Index == AliasMessageWrite {
+			items[i].Index = index
+		}
+	}
+}
+
+// ================================================================================================
+
+type bulkIndexer struct {
+	config IngestConfig
+	queue  chan BulkItem
+	close  chan struct{}
+	done   chan struct{}
+	mutex  *sync.Mutex
+	stats  IngestStats
+}
+
+func newBulkIndexer(config IngestConfig) *bulkIndexer {
+	if config.BatchSize <= 0 {
+		config.BatchSize = 500
+	}
+	if config.Interval <= 0 {
+		config.Interval = time.Second
+	}
+	if config.MaxRetries < 0 {
+		config.MaxRetries = 0
+	}
+	if config.Queue <= 0 {
+		config.Queue = 10000
+	}
+
+	return &bulkIndexer{
+		config: config,
+		queue:  make(chan BulkItem, config.Queue),
+		close:  make(chan struct{}),
+		done:   make(chan struct{}),
+		mutex:  new(sync.Mutex),
+	}
+}
+
+func (bi *bulkIndexer) add(items ...BulkItem) (int, error) {
+	for i, item := range items {
+		select {
+		case bi.queue <- item:
+		default:
+			return i, ErrIngestBusy
+		}
+	}
+
+	return len(items), nil
+}
+
+func (bi *bulkIndexer) Stats() IngestStats {
+	bi.mutex.Lock()
+	defer bi.mutex.Unlock()
+
+	stats := bi.stats
+	stats.Queued = len(bi.queue)
+
+	return stats
+}
+
+func (bi *bulkIndexer) Shutdown() {
+	close(bi.close)
+
+	<-bi.done
+}
+
+func (bi *bulkIndexer) Start() {
+	logger.App().Infoln("======================================== BulkIndexer start ========================================")
+	defer logger.App().Infoln("======================================== BulkIndexer stop ========================================")
+
+	defer close(bi.done)
+
+	ticker := time.NewTicker(bi.config.Interval)
+	defer ticker.Stop()
+
+	batch := make([]BulkItem, 0, bi.config.BatchSize)
+
+	for {
+		select {
+		case <-bi.close:
+			{
+				// 关闭前把队列里剩下的写完
+				for len(bi.queue) > 0 {
+					if batch = append(batch, <-bi.queue); len(batch) >= bi.config.BatchSize {
+						bi.flush(batch)
+						batch = batch[:0]
+					}
+				}
+				bi.flush(batch)
+				return
+			}
+		case item := <-bi.queue:
+			{
+				if batch = append(batch, item); len(batch) >= bi.config.BatchSize {
+					bi.flush(batch)
+					batch = batch[:0]
+				}
+			}
+		case <-ticker.C:
+			{
+				bi.flush(batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+// flush 同一批内按 index+id 去重只保留最后一条，已经存在的消息写回原索引，可重试的失败按指数退避重试
+// 写入成功的文档才清理缓存
+func (bi *bulkIndexer) flush(batch []BulkItem) {
+	if len(batch) == 0 {
+		return
+	}
+
+	positions := make(map[string]int, len(batch))
+	items := make([]BulkItem, 0, len(batch))
+	for _, item := range batch {
+		key := item.Index + "/" + item.ID
+		if position, exist := positions[key]; exist {
+			items[position] = item
+			continue
+		}
+		positions[key] = len(items)
+		items = append(items, item)
+	}
+
+	locate(items)
+
+	backoff := time.Millisecond * time.Duration(500)
+	total := len(items)
+
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(30))
+		failures, err := _backend.Bulk(ctx, items)
+		cancel()
+
+		retry := make([]BulkItem, 0)
+		dropped := 0
+
+		if err != nil {
+			logger.App().Errorf("bulk %d items error : %s", len(items), err.Error())
+			retry = items
+		} else {
+			failed := make(map[int]struct{}, len(failures))
+			for _, failure := range failures {
+				failed[failure.Position] = struct{}{}
+
+				item := items[failure.Position]
+				if failure.Retryable() {
+					retry = append(retry, item)
+					continue
+				}
+				dropped++
+				logger.App().Errorf("bulk drop [%s][%s] : %d - %s", item.Index, item.ID, failure.Status, failure.Reason)
+			}
+
+			indexed := make([]BulkItem, 0, len(items)-len(failed))
+			for position, item := range items {
+				if _, exist := failed[position]; !exist {
+					indexed = append(indexed, item)
+				}
+			}
+			invalidateItems(indexed)
+		}
+
+		if len(retry) > 0 && attempt >= bi.config.MaxRetries {
+			logger.App().Errorf("bulk give up %d items after %d retries", len(retry), attempt)
+			dropped += len(retry)
+			retry = retry[:0]
+		}
+
+		bi.mutex.Lock()
+		bi.stats.Batches++
+		bi.stats.Indexed += uint64(len(items) - len(retry) - dropped)
+		bi.stats.Dropped += uint64(dropped)
+		bi.stats.Retried += uint64(len(retry))
+		bi.mutex.Unlock()
+
+		if len(retry) == 0 {
+			break
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+		items = retry
+	}
+
+	logger.App().Infof("bulk flush %d items", total)
+}
@@ -0,0 +1,117 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func TestFlushUpdatesInPlace(t *testing.T) {
+	mb := setupMemory(t, 0)
+	rms, onIndexed := _rms, _onIndexed
+	t.Cleanup(func() { _rms, _onIndexed = rms, onIndexed })
+	_rms = map[string]*rolloverManager{}
+
+	ctx := context.Background()
+
+	if err := EnsureRollover(SeriesMessage, testMapping(1)); err != nil {
+		t.Fatalf("ensure rollover error : %s", err.Error())
+	}
+	mb.Put(AliasMessageWrite, "old", map[string]any{"id": "old", "content": "电影 旧", "link": "/old"})
+	mb.Put(AliasMessageWrite, "blocked", map[string]any{"id": "blocked", "content": "电影 旧", "link": "/blocked"})
+	if _, err := mb.Rollover(ctx, AliasMessageWrite, nil); err != nil {
+		t.Fatalf("rollover error : %s", err.Error())
+	}
+
+	indices, write, _ := mb.GetAlias(ctx, AliasMessageWrite)
+	stale := ""
+	for _, index := range indices {
+		if index != write {
+			stale = index
+		}
+	}
+
+	links := make([]string, 0)
+	_onIndexed = func(indexed []string) { links = append(links, indexed...) }
+
+	indexer := newBulkIndexer(IngestConfig{})
+	indexer.flush([]BulkItem{
+		{Index: AliasMessageWrite, ID: "old", Source: map[string]any{"id": "old", "content": "电影 新", "link": "/old"}},
+		{Index: AliasMessageWrite, ID: "new", Source: map[string]any{"id": "new", "content": "电影", "link": "/new"}},
+	})
+
+	count := func(id string) map[string]int {
+		data, err := mb.Search(ctx, IndexMessage, map[string]any{"query": map[string]any{"term": map[string]any{"id": id}}})
+		if err != nil {
+			t.Fatalf("search %s error : %s", id, err.Error())
+		}
+
+		var result struct {
+			Hits struct {
+				Hits []struct {
+					Index string `json:"_index"`
+				} `json:"hits"`
+			} `json:"hits"`
+		}
+		if err = json.Unmarshal(data, &result); err != nil {
+			t.Fatalf("unmarshal error : %s", err.Error())
+		}
+
+		found := map[string]int{}
+		for _, hit := range result.Hits.Hits {
+			found[hit.Index]++
+		}
+		return found
+	}
+
+	if found := count("old"); fmt.Sprint(found) != fmt.Sprint(map[string]int{stale: 1}) {
+		t.Fatalf("old is in %v, want only %s", found, stale)
+	}
+	if found := count("new"); fmt.Sprint(found) != fmt.Sprint(map[string]int{write: 1}) {
+		t.Fatalf("new is in %v, want only %s", found, write)
+	}
+
+	// 原索引禁止写入时被拒绝，不通知清理缓存
+	if err := mb.BlockWrites(ctx, stale); err != nil {
+		t.Fatalf("block writes error : %s", err.Error())
+	}
+	indexer.flush([]BulkItem{
+		{Index: AliasMessageWrite, ID: "blocked", Source: map[string]any{"id": "blocked", "content": "电影 新", "link": "/blocked"}},
+	})
+
+	sort.Strings(links)
+	if fmt.Sprint(links) != fmt.Sprint([]string{"/new", "/old"}) {
+		t.Fatalf("indexed links = %v, want [/new /old]", links)
+	}
+	if stats := indexer.Stats(); stats.Indexed != 2 || stats.Dropped != 1 {
+		t.Fatalf("stats = %+v, want 2 indexed and 1 dropped", stats)
+	}
+}
+
+func TestDocumentLink(t *testing.T) {
+	tests := []struct {
+		link    string
+		message bool
+		want    string
+		valid   bool
+	}{
+		{"https://t.me/movies/1", true, "/movies/1", true},
+		{"t.me/movies/1", true, "/movies/1", true},
+		{"/movies/1", true, "/movies/1", true},
+		{"movies", false, "/movies", true},
+		{"https://t.me/movies", true, "", false},
+		{"https://evil/x", true, "", false},
+		{"http://evil/movies", false, "", false},
+		{"/Foo/1?x", true, "", false},
+		{"/movies/1", false, "", false},
+	}
+
+	for _, tt := range tests {
+		link, err := documentLink(tt.link, tt.message)
+		if (err == nil) != tt.valid || link != tt.want {
+			t.Fatalf("documentLink(%q, %v) = %q, %v, want %q, valid %v", tt.link, tt.message, link, err, tt.want, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package search
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	LanguageChinese = "zh"
+	LanguageEnglish = "en"
+	LanguageRussian = "ru"
+	LanguagePersian = "fa"
+)
+
+// 有单独子字段的语言，子字段名和语言代码相同，如 content.en
+var _subLanguages = []string{LanguageEnglish, LanguageRussian, LanguagePersian}
+
+// DetectLanguage 按文字系统粗略判断语言，汉字优先，没有可识别的文字时返回空
+func DetectLanguage(text string) string {
+	han, latin, cyrillic, arabic := 0, 0, 0, 0
+
+	for _, r := range text {
+		switch {
+		case unicode.Is(unicode.Han, r):
+			han++
+		case unicode.Is(unicode.Cyrillic, r):
+			cyrillic++
+		case unicode.Is(unicode.Arabic, r):
+			arabic++
+		case unicode.Is(unicode.Latin, r):
+			latin++
+		}
+	}
+
+	// 一个汉字的信息量大约相当于几个字母，混排时中文优先
+	switch {
+	case han > 0 && han*3 >= latin+cyrillic+arabic:
+		return LanguageChinese
+	case cyrillic > 0 && cyrillic >= latin && cyrillic >= arabic:
+		return LanguageRussian
+	case arabic > 0 && arabic >= latin:
+		return LanguagePersian
+	case latin > 0:
+		return LanguageEnglish
+	case han > 0:
+		return LanguageChinese
+	}
+
+	return ""
+}
+
+// languageOf 调用方给了语言就用给的，否则按文本检测
+func languageOf(lang, text string) string {
+	if lang = normalizeLanguage(lang); lang != "" {
+		return lang
+	}
+
+	return DetectLanguage(text)
+}
+
+// normalizeLanguage Telegram 的 language_code 如 zh-hans、en-US，只取主语言
+func normalizeLanguage(language string) string {
+	language, _, _ = strings.Cut(strings.ToLower(strings.TrimSpace(language)), "-")
+	return language
+}
+
+// languageFields 主字段和各语言子字段，用户语言对应的字段加权，中文或未知语言加权主字段
+func languageFields(field, language string) []string {
+	language = normalizeLanguage(language)
+
+	boosted := field
+	fields := make([]string, 0, len(_subLanguages)+1)
+	for _, sub := range _subLanguages {
+		name := field + "." + sub
+		if sub == language {
+			boosted = name
+		}
+		fields = append(fields, name)
+	}
+	fields = append([]string{field}, fields...)
+
+	for i, name := range fields {
+		if name == boosted {
+			fields[i] = fmt.Sprintf("%s^2", name)
+		}
+	}
+
+	return fields
+}
+
+// languageBoost 和用户同一语言的内容稍微靠前，只影响打分
+func languageBoost(language string) []any {
+	if language = normalizeLanguage(language); language == "" {
+		return []any{}
+	}
+
+	return []any{map[string]any{"term": map[string]any{"lang": map[string]any{"value": language, "boost": 0.5}}}}
+}
@@ -0,0 +1,367 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"jarvis/logger"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/spf13/cast"
+)
+
+// parseMapping 解析 mapping，返回 mappings 和 mappings._meta.version，没有版本时为 0
+func parseMapping(mapping string) (map[string]any, int, error) {
+	var index map[string]any
+	if err := sonic.UnmarshalString(mapping, &index); err != nil {
+		return nil, 0, err
+	}
+
+	mappings, _ := index["mappings"].(map[string]any)
+
+	return mappings, mappingVersion(mappings), nil
+}
+
+func mappingVersion(mappings map[string]any) int {
+	meta, _ := mappings["_meta"].(map[string]any)
+	return cast.ToInt(meta["version"])
+}
+
+func versionedIndex(index string, version int) string {
+	return fmt.Sprintf("%s-v%d", index, version)
+}
+
+// withAlias 给 mapping 加上别名
+func withAlias(mapping, alias string) (string, error) {
+	var index map[string]any
+	if err := sonic.UnmarshalString(mapping, &index); err != nil {
+		return "", err
+	}
+
+	index["aliases"] = map[string]any{alias: map[string]any{}}
+
+	return sonic.MarshalString(index)
+}
+
+// CheckMapping 对比 index（可以是别名）下各索引的实际 mapping 与期望的差异，只打日志不做修改
+func CheckMapping(index, mapping string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(10))
+	defer cancel()
+
+	expected, version, err := parseMapping(mapping)
+	if err != nil {
+		return err
+	}
+
+	actual, err := _backend.GetMapping(ctx, index)
+	if err != nil {
+		return err
+	}
+
+	for name, mappings := range actual {
+		if current := mappingVersion(mappings); current != version {
+			logger.App().Warnf("mapping of [%s] is version %d, expected %d, run migration for [%s]", name, current, version, index)
+		}
+
+		for _, diff := range diffProperties(expected, mappings) {
+			logger.App().Warnf("mapping of [%s] differs : %s", name, diff)
+		}
+	}
+
+	return nil
+}
+
+// diffProperties 列出 expected 中有而 actual 中缺失或类型不同的字段，含子字段
+func diffProperties(expected, actual map[string]any) []string {
+	want, have := make(map[string]string), make(map[string]string)
+	flattenProperties("", expected, want)
+	flattenProperties("", actual, have)
+
+	diffs := make([]string, 0)
+	for field, kind := range want {
+		current, exist := have[field]
+		if !exist {
+			diffs = append(diffs, fmt.Sprintf("missing field [%s]", field))
+			continue
+		}
+		if current != kind {
+			diffs = append(diffs, fmt.Sprintf("field [%s] is %s, expected %s", field, current, kind))
+		}
+	}
+
+	sort.Strings(diffs)
+
+	return diffs
+}
+
+func flattenProperties(prefix string, mappings map[string]any, out map[string]string) {
+	properties, _ := mappings["properties"].(map[string]any)
+
+	for name, raw := range properties {
+		field, _ := raw.(map[string]any)
+
+		key := name
+		if prefix != "" {
+			key = prefix + "." + name
+		}
+
+		out[key] = cast.ToString(field["type"])
+
+		// 对象的子属性和多字段
+		flattenProperties(key, field, out)
+		if fields, ok := field["fields"].(map[string]any); ok {
+			flattenProperties(key, map[string]any{"properties": fields}, out)
+		}
+	}
+}
+
+// MigrateIndex 把别名 index 迁移到新版本的 mapping
+//  1. 禁止写入旧索引，迁移期间的写入会报错而不是在切换别名之后丢失
+//  2. 按 mapping 创建 <index>-v<version>，从旧索引 reindex 过去，失败时恢复旧索引的写入
+//  3. 原子地把别名切到新索引，旧的实体索引直接删除，旧的版本索引保留以便回滚
+func MigrateIndex(index, mapping string) error {
+	ctx := context.Background()
+
+	_, version, err := parseMapping(mapping)
+	if err != nil {
+		return err
+	}
+
+	target := versionedIndex(index, version)
+
+	sources, _, err := _backend.GetAlias(ctx, index)
+	if err != nil {
+		return err
+	}
+
+	// 早期直接用 index 名建的实体索引
+	concrete := false
+	if len(sources) == 0 {
+		exist, err := _backend.IndexExists(ctx, index)
+		if err != nil {
+			return err
+		}
+
+		if !exist {
+			return EnsureIndex(index, mapping)
+		}
+
+		sources, concrete = []string{index}, true
+	}
+
+	for _, source := range sources {
+		if source == target {
+			return errors.New(fmt.Sprintf("[%s] is already on version %d", index, version))
+		}
+	}
+
+	if err = blockWrites(ctx, sources); err != nil {
+		return err
+	}
+
+	logger.App().Infof("migrate [%s] : blocked writes to %v", index, sources)
+
+	if err = reindexInto(ctx, index, sources, target, mapping); err != nil {
+		unblockWrites(ctx, sources)
+		return err
+	}
+
+	actions := []map[string]any{{"add": map[string]any{"index": target, "alias": index}}}
+	for _, source := range sources {
+		if concrete {
+			actions = append(actions, map[string]any{"remove_index": map[string]any{"index": source}})
+		} else {
+			actions = append(actions, map[string]any{"remove": map[string]any{"index": source, "alias": index}})
+		}
+	}
+
+	if err = _backend.UpdateAliases(ctx, actions); err != nil {
+		unblockWrites(ctx, sources)
+		return err
+	}
+
+	if concrete {
+		logger.App().Infof("migrate [%s] : alias switched to [%s], legacy index removed", index, target)
+	} else {
+		logger.App().Infof("migrate [%s] : alias switched to [%s], old indices %v kept", index, target, sources)
+	}
+
+	return nil
+}
+
+// reindexInto 创建 target 并把 sources 全部复制过去
+func reindexInto(ctx context.Context, index string, sources []string, target, mapping string) error {
+	// 上次迁移中断时留下的不完整的新索引，不在别名下，重新来过
+	if exist, err := _backend.IndexExists(ctx, target); err != nil {
+		return err
+	} else if exist {
+		if err = _backend.DeleteIndex(ctx, target); err != nil {
+			return err
+		}
+	}
+
+	if err := _backend.CreateIndex(ctx, target, mapping); err != nil {
+		return err
+	}
+
+	logger.App().Infof("migrate [%s] : created [%s]", index, target)
+
+	for _, source := range sources {
+		count, err := _backend.Reindex(ctx, source, target)
+		if err != nil {
+			return err
+		}
+
+		logger.App().Infof("migrate [%s] : reindexed %d docs from [%s] to [%s]", index, count, source, target)
+	}
+
+	return nil
+}
+
+// blockWrites 禁止写入 indices，中途失败时恢复已经禁止的
+func blockWrites(ctx context.Context, indices []string) error {
+	for i, index := range indices {
+		if err := _backend.BlockWrites(ctx, index); err != nil {
+			unblockWrites(ctx, indices[:i])
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unblockWrites 迁移失败时恢复旧索引的写入，失败只记录日志
+func unblockWrites(ctx context.Context, indices []string) {
+	for _, index := range indices {
+		if err := _backend.UnblockWrites(ctx, index); err != nil {
+			logger.App().Errorf("unblock writes to %s error : %s", index, err.Error())
+		}
+	}
+}
+
+// MigrateRollover 迁移滚动索引
+//  1. 用新 mapping 更新模板
+//  2. 无条件滚动，新的写索引使用新 mapping
+//  3. 禁止写入版本不一致的旧索引，之后的写入会报错而不是在 reindex 之后丢失
+//  4. 每个旧索引 reindex 到不在读别名下的 <index>-v<version>，期间搜索只会看到旧索引，不会重复
+//  5. 原子地把新索引加入读别名并删除旧索引
+func MigrateRollover(series, mapping string) error {
+	ctx := context.Background()
+
+	template, err := templateBody(series, mapping)
+	if err != nil {
+		return err
+	}
+
+	if err = _backend.PutIndexTemplate(ctx, series, template); err != nil {
+		return err
+	}
+
+	_, version, err := parseMapping(mapping)
+	if err != nil {
+		return err
+	}
+
+	mappings, err := _backend.GetMapping(ctx, readAlias(series))
+	if err != nil {
+		return err
+	}
+
+	stale := make([]string, 0)
+	for name, m := range mappings {
+		if mappingVersion(m) != version {
+			stale = append(stale, name)
+		}
+	}
+
+	if len(stale) == 0 {
+		logger.App().Infof("migrate [%s] : already on version %d", series, version)
+		return nil
+	}
+
+	sort.Strings(stale)
+
+	if _, write, err := _backend.GetAlias(ctx, writeAlias(series)); err != nil {
+		return err
+	} else if slices.Contains(stale, write) {
+		target, err := _backend.Rollover(ctx, writeAlias(series), map[string]any{})
+		if err != nil {
+			return err
+		}
+
+		logger.App().Infof("migrate [%s] : rolled over to [%s]", series, target)
+	}
+
+	if err = blockWrites(ctx, stale); err != nil {
+		return err
+	}
+
+	logger.App().Infof("migrate [%s] : blocked writes to %v", series, stale)
+
+	if err = replaceStale(ctx, series, stale, version); err != nil {
+		unblockWrites(ctx, stale)
+		return err
+	}
+
+	logger.App().Infof("migrate [%s] : replaced %v", series, stale)
+
+	return nil
+}
+
+// replaceStale 把旧索引逐个 reindex 到新索引，全部完成后原子地替换
+func replaceStale(ctx context.Context, series string, stale []string, version int) error {
+	actions := make([]map[string]any, 0, len(stale)*2)
+	for _, source := range stale {
+		target := stagingIndex(series, source, version)
+
+		// 上次迁移中断时留下的不完整的新索引，旧索引还在，重新来过
+		if exist, err := _backend.IndexExists(ctx, target); err != nil {
+			return err
+		} else if exist {
+			if err = _backend.DeleteIndex(ctx, target); err != nil {
+				return err
+			}
+		}
+
+		// 模板会把新索引加入读别名，reindex 完成之前先移出来
+		if err := _backend.CreateIndex(ctx, target, ""); err != nil {
+			return err
+		}
+		if err := _backend.UpdateAliases(ctx, []map[string]any{
+			{"remove": map[string]any{"index": target, "alias": readAlias(series)}},
+		}); err != nil {
+			return err
+		}
+
+		count, err := _backend.Reindex(ctx, source, target)
+		if err != nil {
+			return err
+		}
+
+		logger.App().Infof("migrate [%s] : reindexed %d docs from [%s] to [%s]", series, count, source, target)
+
+		actions = append(actions,
+			map[string]any{"add": map[string]any{"index": target, "alias": readAlias(series)}},
+			map[string]any{"remove_index": map[string]any{"index": source}},
+		)
+	}
+
+	return _backend.UpdateAliases(ctx, actions)
+}
+
+// stagingIndex 旧索引迁移后的名字，message-000001 和 message-000001-v2 都迁移到 message-000001-v3
+// 旧的单索引 message 不匹配模板，迁移到 message-000000-v3，排在最前面最先被清理
+func stagingIndex(series, source string, version int) string {
+	base := source
+	if source == series {
+		base = fmt.Sprintf("%s-%06d", series, 0)
+	} else if pos := strings.LastIndex(source, "-v"); pos > len(series) {
+		base = source[:pos]
+	}
+
+	return versionedIndex(base, version)
+}
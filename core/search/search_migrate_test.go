@@ -0,0 +1,194 @@
+package search
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/bytedance/sonic"
+)
+
+func testMapping(version int) string {
+	return fmt.Sprintf(`{"mappings":{"_meta":{"version":%d},"properties":{"content":{"type":"text"}}}}`, version)
+}
+
+func TestMigrateRollover(t *testing.T) {
+	mb := setupMemory(t, 0)
+	rms := _rms
+	t.Cleanup(func() { _rms = rms })
+	_rms = map[string]*rolloverManager{}
+
+	ctx := context.Background()
+
+	// 旧的单索引和滚动索引各一份数据
+	if err := mb.CreateIndex(ctx, SeriesMessage, testMapping(1)); err != nil {
+		t.Fatalf("create legacy index error : %s", err.Error())
+	}
+	mb.Put(SeriesMessage, "legacy", map[string]any{"id": 0, "content": "电影 旧"})
+
+	if err := EnsureRollover(SeriesMessage, testMapping(1)); err != nil {
+		t.Fatalf("ensure rollover error : %s", err.Error())
+	}
+	for i := 1; i <= 3; i++ {
+		mb.Put(AliasMessageWrite, fmt.Sprintf("%d", i), map[string]any{"id": i, "content": "电影"})
+	}
+
+	if err := MigrateRollover(SeriesMessage, testMapping(2)); err != nil {
+		t.Fatalf("migrate error : %s", err.Error())
+	}
+
+	indices, write, _ := mb.GetAlias(ctx, readAlias(SeriesMessage))
+	sort.Strings(indices)
+	want := []string{"message-000000-v2", "message-000001-v2", "message-000002"}
+	if fmt.Sprint(indices) != fmt.Sprint(want) {
+		t.Fatalf("read alias = %v, want %v", indices, want)
+	}
+	if _, write, _ = mb.GetAlias(ctx, writeAlias(SeriesMessage)); write != "message-000002" {
+		t.Fatalf("write alias = %s, want message-000002", write)
+	}
+
+	mappings, _ := mb.GetMapping(ctx, readAlias(SeriesMessage))
+	for name, m := range mappings {
+		if mappingVersion(m) != 2 {
+			t.Fatalf("mapping of %s is version %d", name, mappingVersion(m))
+		}
+	}
+
+	// 每条文档只出现一次
+	data, err := mb.Search(ctx, readAlias(SeriesMessage), map[string]any{"size": 100, "query": map[string]any{"match_all": map[string]any{}}})
+	if err != nil {
+		t.Fatalf("search error : %s", err.Error())
+	}
+	result := new(Result)
+	if err = sonic.Unmarshal(data, result); err != nil {
+		t.Fatalf("unmarshal error : %s", err.Error())
+	}
+	if len(result.Hits.Hits) != 4 {
+		t.Fatalf("got %d docs after migration, want 4", len(result.Hits.Hits))
+	}
+
+	// 已经是新版本时不做任何事
+	if err = MigrateRollover(SeriesMessage, testMapping(2)); err != nil {
+		t.Fatalf("migrate again error : %s", err.Error())
+	}
+}
+
+func TestStagingIndex(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"message", "message-000000-v3"},
+		{"message-000001", "message-000001-v3"},
+		{"message-000001-v2", "message-000001-v3"},
+	}
+
+	for _, tt := range tests {
+		if got := stagingIndex(SeriesMessage, tt.source, 3); got != tt.want {
+			t.Fatalf("stagingIndex(%s) = %s, want %s", tt.source, got, tt.want)
+		}
+	}
+}
+
+func TestRetireKeepsLegacy(t *testing.T) {
+	mb := setupMemory(t, 0)
+	rms := _rms
+	t.Cleanup(func() { _rms = rms })
+	_rms = map[string]*rolloverManager{}
+
+	ctx := context.Background()
+
+	if err := mb.CreateIndex(ctx, SeriesMessage, testMapping(1)); err != nil {
+		t.Fatalf("create legacy index error : %s", err.Error())
+	}
+	if err := EnsureRollover(SeriesMessage, testMapping(1)); err != nil {
+		t.Fatalf("ensure rollover error : %s", err.Error())
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := mb.Rollover(ctx, AliasMessageWrite, nil); err != nil {
+			t.Fatalf("rollover error : %s", err.Error())
+		}
+	}
+
+	rm := newRolloverManager(SeriesMessage, RolloverConfig{MaxIndices: 2})
+	rm.retire()
+
+	indices, _, _ := mb.GetAlias(ctx, readAlias(SeriesMessage))
+	sort.Strings(indices)
+	want := []string{SeriesMessage, "message-000003", "message-000004"}
+	if fmt.Sprint(indices) != fmt.Sprint(want) {
+		t.Fatalf("read alias = %v, want %v", indices, want)
+	}
+	if stats := rm.Stats(); fmt.Sprint(stats.Indices) != fmt.Sprint(want) {
+		t.Fatalf("stats indices = %v, want %v", stats.Indices, want)
+	}
+}
+
+func TestMigrateIndex(t *testing.T) {
+	mb := setupMemory(t, 0)
+	ctx := context.Background()
+
+	if err := mb.CreateIndex(ctx, IndexCog, testMapping(1)); err != nil {
+		t.Fatalf("create legacy index error : %s", err.Error())
+	}
+	mb.Put(IndexCog, "1", map[string]any{"id": "1"})
+
+	for version := 2; version <= 3; version++ {
+		if err := MigrateIndex(IndexCog, testMapping(version)); err != nil {
+			t.Fatalf("migrate to version %d error : %s", version, err.Error())
+		}
+	}
+
+	indices, _, _ := mb.GetAlias(ctx, IndexCog)
+	if fmt.Sprint(indices) != "[cog-v3]" {
+		t.Fatalf("alias = %v, want [cog-v3]", indices)
+	}
+
+	// 旧的版本索引保留但禁止写入，通过别名的写入落到新索引
+	if failures, _ := mb.Bulk(ctx, []BulkItem{{Index: "cog-v2", ID: "2", Source: map[string]any{"id": "2"}}}); len(failures) != 1 {
+		t.Fatalf("write to cog-v2 is not blocked")
+	}
+	if failures, _ := mb.Bulk(ctx, []BulkItem{{Index: IndexCog, ID: "2", Source: map[string]any{"id": "2"}}}); len(failures) != 0 {
+		t.Fatalf("write through alias failed : %+v", failures)
+	}
+
+	data, _ := mb.Search(ctx, IndexCog, map[string]any{"query": map[string]any{"match_all": map[string]any{}}})
+	var result struct {
+		Hits struct {
+			Hits []any `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := sonic.Unmarshal(data, &result); err != nil || len(result.Hits.Hits) != 2 {
+		t.Fatalf("got %d docs through alias, want 2", len(result.Hits.Hits))
+	}
+}
+
+func TestEnsureRolloverRankingFields(t *testing.T) {
+	mb := setupMemory(t, 0)
+	rms := _rms
+	t.Cleanup(func() { _rms = rms })
+	_rms = map[string]*rolloverManager{}
+
+	ctx := context.Background()
+
+	if err := mb.CreateIndex(ctx, SeriesMessage, testMapping(1)); err != nil {
+		t.Fatalf("create legacy index error : %s", err.Error())
+	}
+
+	mapping := `{"mappings":{"_meta":{"version":2},"properties":{"content":{"type":"text"},"score":{"type":"integer"},"posted_at":{"type":"date","format":"epoch_millis"}}}}`
+	if err := EnsureRollover(SeriesMessage, mapping); err != nil {
+		t.Fatalf("ensure rollover error : %s", err.Error())
+	}
+
+	mappings, _ := mb.GetMapping(ctx, SeriesMessage)
+	properties, _ := mappings[SeriesMessage]["properties"].(map[string]any)
+	for _, field := range []string{"content", "score", "posted_at"} {
+		if _, exist := properties[field]; !exist {
+			t.Fatalf("legacy index has no %s : %v", field, properties)
+		}
+	}
+	if version := mappingVersion(mappings[SeriesMessage]); version != 1 {
+		t.Fatalf("legacy index is version %d, want 1", version)
+	}
+}
@@ -1,52 +1,119 @@
 package search
 
 import (
-	"encoding/json"
-	"errors"
+	"context"
 	"fmt"
-	"jarvis/dao/db/elasticsearch"
 	"jarvis/logger"
-	"strings"
 	"sync"
 	"time"
 )
 
+const (
+	_pitCloseGrace = time.Second * time.Duration(15) // 轮换后旧 pit 延迟关闭，留给进行中的查询
+	_pitMinBackoff = time.Second
+)
+
 var (
-	_pm PITManager
+	_pms = map[string]PITManager{}
 )
 
 type PITManager interface {
 	Start()
 	Get() string
+	KeepAlive() string
+	Rotation() time.Duration
+	Stats() PITStats
 	Shutdown()
 }
 
+type PITStats struct {
+	Index        string    `json:"index"`
+	Pool         uint64    `json:"pool"`
+	Open         int       `json:"open"`
+	LastRotation time.Time `json:"last_rotation"`
+	Failures     uint64    `json:"failures"`
+	LastError    string    `json:"last_error"`
+}
+
 type pitManager struct {
-	index   string
-	amount  uint64
-	close   chan struct{}
-	done    chan struct{}
-	mutex   *sync.Mutex
-	last    []string
-	current []string
-	next    []string
-	idx     int
+	index     string
+	amount    uint64
+	keepAlive time.Duration
+	rotation  time.Duration
+	close     chan struct{}
+	done      chan struct{}
+	mutex     *sync.Mutex
+	last      []string
+	current   []string
+	idx       int
+	stats     PITStats
+}
+
+func newPITManager(index string, amount uint64, keepAlive, rotation time.Duration) *pitManager {
+	if rotation <= 0 {
+		rotation = time.Minute
+	}
+
+	// 旧 pit 在下一次轮换之前关闭，否则每次轮换都会推迟关闭，旧 pit 越积越多
+	if rotation < _pitCloseGrace {
+		logger.App().Warnf("pit [%s] rotation %s is shorter than %s, use %s instead", index, rotation, _pitCloseGrace, _pitCloseGrace)
+		rotation = _pitCloseGrace
+	}
+
+	// pit 必须活过一次轮换加上延迟关闭的时间
+	if keepAlive < rotation+_pitCloseGrace {
+		logger.App().Warnf("pit [%s] keep alive %s is shorter than rotation %s + %s, use %s instead", index, keepAlive, rotation, _pitCloseGrace, rotation+_pitCloseGrace)
+		keepAlive = rotation + _pitCloseGrace
+	}
+
+	return &pitManager{
+		index:     index,
+		amount:    amount,
+		keepAlive: keepAlive,
+		rotation:  rotation,
+		close:     make(chan struct{}),
+		done:      make(chan struct{}),
+		mutex:     new(sync.Mutex),
+		last:      make([]string, 0),
+		current:   make([]string, 0),
+		idx:       0,
+		stats:     PITStats{Index: index, Pool: amount},
+	}
 }
 
 func (pm *pitManager) Get() string {
-	if pm.current == nil || len(pm.current) == 0 {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	if len(pm.current) == 0 {
 		return ""
 	}
 
-	pm.mutex.Lock()
 	pm.idx = pm.idx % len(pm.current)
 	pid := pm.current[pm.idx]
 	pm.idx++
-	pm.mutex.Unlock()
 
 	return pid
 }
 
+func (pm *pitManager) KeepAlive() string {
+	return fmt.Sprintf("%ds", int(pm.keepAlive.Seconds()))
+}
+
+func (pm *pitManager) Rotation() time.Duration {
+	return pm.rotation
+}
+
+func (pm *pitManager) Stats() PITStats {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	stats := pm.stats
+	stats.Open = len(pm.current)
+
+	return stats
+}
+
 func (pm *pitManager) Shutdown() {
 	close(pm.close)
 
@@ -54,103 +121,105 @@ func (pm *pitManager) Shutdown() {
 }
 
 func (pm *pitManager) Start() {
-	logger.App().Infoln("======================================== PITManager start ========================================")
-	defer logger.App().Infoln("======================================== PITManager stop ========================================")
+	logger.App().Infof("======================================== PITManager [%s] start ========================================", pm.index)
+	defer logger.App().Infof("======================================== PITManager [%s] stop ========================================", pm.index)
 
-	pm.generateCurrent()
+	defer close(pm.done)
 
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
+	rotate := time.NewTimer(0)
+	defer rotate.Stop()
 
-	for {
-		done := false
+	closing := time.NewTimer(pm.rotation)
+	closing.Stop()
+	defer closing.Stop()
 
+	backoff := _pitMinBackoff
+
+	for {
 		select {
 		case <-pm.close:
 			{
-				done = true
+				pm.mutex.Lock()
+				pits := append(pm.last, pm.current...)
+				pm.last, pm.current = make([]string, 0), make([]string, 0)
+				pm.mutex.Unlock()
+
+				if err := closePits(pits...); err != nil {
+					logger.App().Errorf("close %s pits error : %s", pm.index, err.Error())
+				}
+				return
 			}
-		case now := <-ticker.C:
+		case <-rotate.C:
 			{
-				if now.Second() == 50 {
-					if err := pm.generateNext(); err != nil {
-						logger.App().Errorf("generate next error : %s", err.Error())
-					}
-					continue
-				}
+				if err := pm.rotate(); err != nil {
+					logger.App().Errorf("rotate %s pits error, retry in %s : %s", pm.index, backoff, err.Error())
 
-				if now.Second() == 0 {
-					pm.mutex.Lock()
-					if len(pm.next) == 0 {
-						pm.mutex.Unlock()
-						if err := pm.generateNext(); err != nil {
-							logger.App().Errorf("generate next error : %s", err.Error())
-						}
-						pm.mutex.Lock()
+					rotate.Reset(backoff)
+					if backoff *= 2; backoff > pm.rotation {
+						backoff = pm.rotation
 					}
-					pm.last = pm.current[:]
-					pm.current = pm.next[:]
-					pm.mutex.Unlock()
-					logger.App().Infof("finish switch next to current : %d - %d", len(pm.last), len(pm.next))
-					pm.next = make([]string, 0)
 					continue
 				}
 
-				if now.Second() == 15 {
-					pm.closeLast()
-					continue
-				}
+				backoff = _pitMinBackoff
+				rotate.Reset(pm.rotation)
+				closing.Reset(_pitCloseGrace)
+			}
+		case <-closing.C:
+			{
+				pm.closeLast()
 			}
-		}
-
-		if done {
-			break
 		}
 	}
-
 }
 
-func (pm *pitManager) generateCurrent() {
-	list, err := generate(pm.index, pm.amount)
-	if err != nil {
-		logger.App().Error("generate error : %s", err.Error())
-		return
-	}
+// rotate 打开一批新的 pit 替换当前的，旧的进入 last 等待关闭
+func (pm *pitManager) rotate() error {
+	list, err := generate(pm.index, pm.amount, pm.KeepAlive())
+
 	pm.mutex.Lock()
-	pm.current = list[:]
-	pm.mutex.Unlock()
-}
+	defer pm.mutex.Unlock()
 
-func (pm *pitManager) generateNext() error {
-	list := make([]string, 0)
-	var err error
-	for i := 0; i < 3; i++ {
-		list, err = generate(pm.index, pm.amount)
-		if err != nil {
-			continue
-		}
-		break
-	}
 	if err != nil {
+		pm.stats.Failures++
+		pm.stats.LastError = err.Error()
+
+		// 池子已空时先用上成功打开的部分
+		if len(pm.current) == 0 && len(list) > 0 {
+			pm.current = list[:]
+			return err
+		}
+
+		if len(list) > 0 {
+			go func() { _ = closePits(list...) }()
+		}
 		return err
 	}
 
-	pm.mutex.Lock()
-	pm.next = list[:]
-	pm.mutex.Unlock()
+	pm.last = append(pm.last, pm.current...)
+	pm.current = list[:]
+	pm.stats.LastRotation = time.Now()
+	pm.stats.LastError = ""
+
+	logger.App().Infof("finish rotate %s pits : %d - %d", pm.index, len(pm.last), len(pm.current))
 
 	return nil
 }
 
 func (pm *pitManager) closeLast() {
-	if pm.last != nil && len(pm.last) > 0 {
-		if err := closePits(pm.last...); err != nil {
-			logger.App().Errorf("close %+v error : %s", pm.last, err.Error())
+	pm.mutex.Lock()
+	last := pm.last
+	pm.last = make([]string, 0)
+	pm.mutex.Unlock()
+
+	if len(last) > 0 {
+		if err := closePits(last...); err != nil {
+			logger.App().Errorf("close %+v error : %s", last, err.Error())
 		}
 	}
 }
 
-func generate(index string, amount uint64) ([]string, error) {
+func generate(index string, amount uint64, keepAlive string) ([]string, error) {
 	if amount == 0 {
 		return []string{}, nil
 	}
@@ -159,20 +228,15 @@ func generate(index string, amount uint64) ([]string, error) {
 
 	var err error
 	for i := 0; i < int(amount); i++ {
-		pitRes, opitErr := elasticsearch.Instance().OpenPointInTime([]string{index}, "2m")
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(5))
+		id, opitErr := _backend.OpenPIT(ctx, index, keepAlive)
+		cancel()
 		if opitErr != nil {
 			err = opitErr
 			break
 		}
-		var pitResponse map[string]interface{}
-		if err = json.NewDecoder(pitRes.Body).Decode(&pitResponse); err != nil {
-			_ = pitRes.Body.Close()
-			break
-		}
-		id := pitResponse["id"].(string)
 
 		tmp = append(tmp, id)
-		_ = pitRes.Body.Close()
 	}
 
 	return tmp[:], err
@@ -186,24 +250,31 @@ func closePits(pits ...string) error {
 	var err error
 
 	for _, id := range pits {
-		closePitRes, cpitErr := elasticsearch.Instance().ClosePointInTime(
-			elasticsearch.Instance().ClosePointInTime.WithBody(
-				strings.NewReader(
-					fmt.Sprintf("{\"id\":\"%s\"}", id),
-				),
-			),
-		)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(5))
+		cpitErr := _backend.ClosePIT(ctx, id)
+		cancel()
 		if cpitErr != nil {
 			err = cpitErr
-			break
-		} else {
-			if closePitRes.IsError() {
-				err = errors.New(fmt.Sprintf("%s : %s", id, closePitRes.String()))
-				_ = closePitRes.Body.Close()
-				break
-			}
 		}
 	}
 
 	return err
 }
+
+// getPIT 取索引对应的 pit 条件，没有可用 pit 时返回 nil
+func getPIT(index string) map[string]any {
+	pm, exist := _pms[index]
+	if !exist {
+		return nil
+	}
+
+	pit := pm.Get()
+	if pit == "" {
+		return nil
+	}
+
+	return map[string]any{
+		"id":         pit,
+		"keep_alive": pm.KeepAlive(),
+	}
+}
@@ -0,0 +1,332 @@
+package search
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/spf13/cast"
+)
+
+// 支持半角和全角的引号、加减号
+var (
+	_quotes = map[rune]rune{
+		'"': '"',
+		'“': '”',
+		'＂': '＂',
+		'「': '」',
+		'『': '』',
+	}
+	_plus  = map[rune]struct{}{'+': {}, '＋': {}}
+	_minus = map[rune]struct{}{'-': {}, '－': {}}
+)
+
+const (
+	OperatorType        = "type"
+	OperatorLink        = "link"
+	OperatorMinMembers  = "min_members"
+	OperatorMinMessages = "min_messages"
+)
+
+// Operators 支持的操作符，用于提示用户
+var Operators = []string{OperatorType, OperatorLink, OperatorMinMembers, OperatorMinMessages}
+
+// 操作符 type 的取值，和搜索类型对应
+var _operatorTypes = map[string]uint8{
+	"all": 0, "全部": 0,
+	"group": CogTypeGroup, "群组": CogTypeGroup,
+	"channel": CogTypeChannel, "频道": CogTypeChannel,
+	"video": 3, "视频": 3,
+	"photo": 4, "图片": 4,
+	"voice": 5, "音频": 5,
+	"text": 6, "文字": 6,
+	"file": 7, "文件": 7,
+	"bot": SearchTypeBot, "机器人": SearchTypeBot,
+	"media": SearchTypeMedia, "图片视频": SearchTypeMedia,
+}
+
+// OperatorError 查询中有无法识别的操作符或取值
+type OperatorError struct {
+	Operators []string
+}
+
+func (oe *OperatorError) Error() string {
+	return fmt.Sprintf("unknown operators : %s", strings.Join(oe.Operators, " "))
+}
+
+// QueryFilters 操作符对应的过滤条件
+type QueryFilters struct {
+	Type        *uint8 // 覆盖按钮选择的搜索类型
+	Link        string // 规范化后的链接，如 /channel
+	MinMembers  int
+	MinMessages int
+}
+
+func (qf QueryFilters) empty() bool {
+	return qf.Type == nil && qf.Link == "" && qf.MinMembers == 0 && qf.MinMessages == 0
+}
+
+// Term 查询中的一个词或短语
+type Term struct {
+	Text   string
+	Phrase bool // 引号括起来的短语，按 match_phrase 精确匹配
+}
+
+// Query 用户输入解析后的结构
+//
+//	普通词        合并成一个 match，和原来的行为一致
+//	"短语"        必须完整出现
+//	+词           必须出现
+//	-词 -"短语"   不能出现
+//	a OR b        至少出现一个，OR 也可以写成 |
+//	name:value    操作符，见 Operators
+type Query struct {
+	Text     string // 去掉操作符之后的原文
+	Terms    []string
+	Required []Term
+	Excluded []Term
+	Any      [][]Term
+	Filters  QueryFilters
+	Unknown  []string // 无法识别的操作符或取值，原样保留
+}
+
+type queryToken struct {
+	Term
+	raw    string
+	prefix rune // '+' '-' 或 0
+	or     bool
+}
+
+// ParseQuery 解析用户输入，不会失败，无法识别的语法按普通词处理
+func ParseQuery(text string) Query {
+	query := Query{
+		Terms:    make([]string, 0),
+		Required: make([]Term, 0),
+		Excluded: make([]Term, 0),
+		Any:      make([][]Term, 0),
+		Unknown:  make([]string, 0),
+	}
+
+	// 先按 OR 分组，每组只有一个词的再按类型归类
+	groups, join, raws := make([][]queryToken, 0), false, make([]string, 0)
+	for _, token := range tokenizeQuery(text) {
+		if name, value, ok := cutOperator(token); ok {
+			if !query.Filters.apply(name, value) {
+				query.Unknown = append(query.Unknown, token.raw)
+			}
+			continue
+		}
+
+		raws = append(raws, token.raw)
+
+		switch {
+		case token.or:
+			join = len(groups) > 0
+		case token.prefix == '-':
+			query.Excluded = append(query.Excluded, token.Term)
+			join = false
+		case join:
+			groups[len(groups)-1] = append(groups[len(groups)-1], token)
+			join = false
+		default:
+			groups = append(groups, []queryToken{token})
+		}
+	}
+
+	for _, group := range groups {
+		if len(group) > 1 {
+			terms := make([]Term, 0, len(group))
+			for _, token := range group {
+				terms = append(terms, token.Term)
+			}
+			query.Any = append(query.Any, terms)
+			continue
+		}
+
+		if token := group[0]; token.Phrase || token.prefix == '+' {
+			query.Required = append(query.Required, token.Term)
+		} else {
+			query.Terms = append(query.Terms, token.Text)
+		}
+	}
+
+	query.Text = strings.Join(raws, " ")
+
+	return query
+}
+
+// cutOperator 拆出 name:value，name 只能是小写字母和下划线，排除 https://
+func cutOperator(token queryToken) (string, string, bool) {
+	if token.Phrase || token.prefix != 0 {
+		return "", "", false
+	}
+
+	text := strings.Replace(token.Text, "：", ":", 1)
+
+	name, value, ok := strings.Cut(text, ":")
+	if !ok || name == "" || value == "" || strings.HasPrefix(value, "//") {
+		return "", "", false
+	}
+
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && r != '_' {
+			return "", "", false
+		}
+	}
+
+	return name, value, true
+}
+
+// apply 设置操作符对应的过滤条件，操作符或取值无效时返回 false
+func (qf *QueryFilters) apply(name, value string) bool {
+	switch name {
+	case OperatorType:
+		t, exist := _operatorTypes[strings.ToLower(value)]
+		if !exist {
+			return false
+		}
+		qf.Type = &t
+	case OperatorLink:
+		// @channel 和 t.me/channel 都可以
+		if qf.Link = NormalizeLink(strings.TrimPrefix(value, "@")); qf.Link == "/" {
+			return false
+		}
+	case OperatorMinMembers, OperatorMinMessages:
+		count, err := cast.ToIntE(value)
+		if err != nil || count < 0 {
+			return false
+		}
+		if name == OperatorMinMembers {
+			qf.MinMembers = count
+		} else {
+			qf.MinMessages = count
+		}
+	default:
+		return false
+	}
+
+	return true
+}
+
+// Empty 没有任何正向的条件
+func (q Query) Empty() bool {
+	return len(q.Terms) == 0 && len(q.Required) == 0 && len(q.Any) == 0
+}
+
+// clauses 生成 bool 查询的 must 和 must_not，fields 为主字段和各语言子字段
+func (q Query) clauses(fields []string) ([]any, []any) {
+	must, mustNot := make([]any, 0), make([]any, 0)
+
+	if len(q.Terms) > 0 {
+		must = append(must, multiMatch(fields, strings.Join(q.Terms, " "), nil))
+	}
+
+	for _, term := range q.Required {
+		if term.Phrase {
+			must = append(must, term.clause(fields))
+			continue
+		}
+		// 词本身会被分词，要求分出来的都出现
+		must = append(must, multiMatch(fields, term.Text, map[string]any{"operator": "and"}))
+	}
+
+	for _, terms := range q.Any {
+		should := make([]any, 0, len(terms))
+		for _, term := range terms {
+			should = append(should, term.clause(fields))
+		}
+		must = append(must, map[string]any{"bool": map[string]any{"should": should, "minimum_should_match": 1}})
+	}
+
+	// 排除的词按短语处理，避免把只包含其中一个字的内容也排除掉
+	for _, term := range q.Excluded {
+		mustNot = append(mustNot, multiMatch(fields, term.Text, map[string]any{"type": "phrase"}))
+	}
+
+	return must, mustNot
+}
+
+func (t Term) clause(fields []string) map[string]any {
+	if t.Phrase {
+		return multiMatch(fields, t.Text, map[string]any{"type": "phrase"})
+	}
+
+	return multiMatch(fields, t.Text, nil)
+}
+
+func multiMatch(fields []string, text string, options map[string]any) map[string]any {
+	clause := map[string]any{"query": text, "fields": fields}
+	for key, value := range options {
+		clause[key] = value
+	}
+
+	return map[string]any{"multi_match": clause}
+}
+
+// textQuery 生成 bool 查询的 must 和 must_not，只有排除词时匹配全部再排除，只有操作符时只按操作符过滤
+func (q Query) textQuery(fields []string) ([]any, []any) {
+	if !q.Empty() {
+		return q.clauses(fields)
+	}
+
+	if len(q.Excluded) > 0 {
+		_, mustNot := q.clauses(fields)
+		return []any{map[string]any{"match_all": map[string]any{}}}, mustNot
+	}
+
+	if q.Text == "" && !q.Filters.empty() {
+		return []any{}, []any{}
+	}
+
+	return []any{multiMatch(fields, q.Text, nil)}, []any{}
+}
+
+func tokenizeQuery(text string) []queryToken {
+	runes, tokens := []rune(text), make([]queryToken, 0)
+
+	for i := 0; i < len(runes); {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+
+		token, begin := queryToken{}, i
+
+		// 前缀后面紧跟内容才算，单独的 + - 忽略
+		if _, ok := _plus[runes[i]]; ok {
+			token.prefix = '+'
+		} else if _, ok = _minus[runes[i]]; ok {
+			token.prefix = '-'
+		}
+		if token.prefix != 0 {
+			if i++; i >= len(runes) || unicode.IsSpace(runes[i]) {
+				continue
+			}
+		}
+
+		if closing, ok := _quotes[runes[i]]; ok {
+			// 没有闭合的引号一直取到结尾
+			start := i + 1
+			for i = start; i < len(runes) && runes[i] != closing; i++ {
+			}
+			token.Text, token.Phrase = strings.TrimSpace(string(runes[start:min(i, len(runes))])), true
+			i++
+		} else {
+			start := i
+			for ; i < len(runes) && !unicode.IsSpace(runes[i]); i++ {
+			}
+			token.Text = string(runes[start:i])
+			token.or = token.prefix == 0 && (token.Text == "OR" || token.Text == "|")
+		}
+
+		if token.Text == "" {
+			continue
+		}
+
+		token.raw = string(runes[begin:min(i, len(runes))])
+
+		tokens = append(tokens, token)
+	}
+
+	return tokens
+}
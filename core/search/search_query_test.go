@@ -0,0 +1,233 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenizeQuery(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []queryToken
+	}{
+		{
+			name: "chinese",
+			text: "电影 下载",
+			want: []queryToken{
+				{Term: Term{Text: "电影"}, raw: "电影"},
+				{Term: Term{Text: "下载"}, raw: "下载"},
+			},
+		},
+		{
+			name: "full-width quotes",
+			text: "“流浪 地球” 「三体」",
+			want: []queryToken{
+				{Term: Term{Text: "流浪 地球", Phrase: true}, raw: "“流浪 地球”"},
+				{Term: Term{Text: "三体", Phrase: true}, raw: "「三体」"},
+			},
+		},
+		{
+			name: "full-width signs",
+			text: "＋电影 －广告 －“免费 领取”",
+			want: []queryToken{
+				{Term: Term{Text: "电影"}, raw: "＋电影", prefix: '+'},
+				{Term: Term{Text: "广告"}, raw: "－广告", prefix: '-'},
+				{Term: Term{Text: "免费 领取", Phrase: true}, raw: "－“免费 领取”", prefix: '-'},
+			},
+		},
+		{
+			name: "or",
+			text: "movie OR 电影 | film",
+			want: []queryToken{
+				{Term: Term{Text: "movie"}, raw: "movie"},
+				{Term: Term{Text: "OR"}, raw: "OR", or: true},
+				{Term: Term{Text: "电影"}, raw: "电影"},
+				{Term: Term{Text: "|"}, raw: "|", or: true},
+				{Term: Term{Text: "film"}, raw: "film"},
+			},
+		},
+		{
+			name: "unclosed quote",
+			text: `a "hello world`,
+			want: []queryToken{
+				{Term: Term{Text: "a"}, raw: "a"},
+				{Term: Term{Text: "hello world", Phrase: true}, raw: `"hello world`},
+			},
+		},
+		{
+			name: "bare signs",
+			text: "+ 电影 - ＋ －",
+			want: []queryToken{
+				{Term: Term{Text: "电影"}, raw: "电影"},
+			},
+		},
+		{
+			name: "empty quotes",
+			text: `"" 电影`,
+			want: []queryToken{
+				{Term: Term{Text: "电影"}, raw: "电影"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tokenizeQuery(tt.text); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("tokenizeQuery(%q) = %+v, want %+v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	video, group := uint8(3), CogTypeGroup
+
+	tests := []struct {
+		name string
+		text string
+		want Query
+	}{
+		{
+			name: "plain",
+			text: "流浪地球 4K",
+			want: Query{Text: "流浪地球 4K", Terms: []string{"流浪地球", "4K"}},
+		},
+		{
+			name: "phrase and required",
+			text: "“流浪 地球” ＋高清 电影",
+			want: Query{
+				Text:     "“流浪 地球” ＋高清 电影",
+				Terms:    []string{"电影"},
+				Required: []Term{{Text: "流浪 地球", Phrase: true}, {Text: "高清"}},
+			},
+		},
+		{
+			name: "excluded",
+			text: "电影 -广告 －「免费 领取」",
+			want: Query{
+				Text:     "电影 -广告 －「免费 领取」",
+				Terms:    []string{"电影"},
+				Excluded: []Term{{Text: "广告"}, {Text: "免费 领取", Phrase: true}},
+			},
+		},
+		{
+			name: "mixed or",
+			text: "movie OR 电影 | film 下载",
+			want: Query{
+				Text:  "movie OR 电影 | film 下载",
+				Terms: []string{"下载"},
+				Any:   [][]Term{{{Text: "movie"}, {Text: "电影"}, {Text: "film"}}},
+			},
+		},
+		{
+			name: "lowercase or is a term",
+			text: "a or b",
+			want: Query{Text: "a or b", Terms: []string{"a", "or", "b"}},
+		},
+		{
+			name: "leading and trailing or",
+			text: "OR 电影 OR",
+			want: Query{Text: "OR 电影 OR", Terms: []string{"电影"}},
+		},
+		{
+			name: "unclosed quote",
+			text: "电影 「流浪 地球",
+			want: Query{
+				Text:     "电影 「流浪 地球",
+				Terms:    []string{"电影"},
+				Required: []Term{{Text: "流浪 地球", Phrase: true}},
+			},
+		},
+		{
+			name: "bare signs",
+			text: "电影 + -",
+			want: Query{Text: "电影", Terms: []string{"电影"}},
+		},
+		{
+			name: "operators",
+			text: "type:video 电影 min_members：100",
+			want: Query{
+				Text:    "电影",
+				Terms:   []string{"电影"},
+				Filters: QueryFilters{Type: &video, MinMembers: 100},
+			},
+		},
+		{
+			name: "chinese operator value",
+			text: "type:群组 link:@movies",
+			want: Query{Filters: QueryFilters{Type: &group, Link: "/movies"}},
+		},
+		{
+			name: "unknown operators",
+			text: "color:red type:movie 电影",
+			want: Query{Text: "电影", Terms: []string{"电影"}, Unknown: []string{"color:red", "type:movie"}},
+		},
+		{
+			name: "links are not operators",
+			text: "https://t.me/movies http://example.com",
+			want: Query{
+				Text:  "https://t.me/movies http://example.com",
+				Terms: []string{"https://t.me/movies", "http://example.com"},
+			},
+		},
+		{
+			name: "prefixed and quoted operators are terms",
+			text: `+type:video "link:@movies"`,
+			want: Query{
+				Text:     `+type:video "link:@movies"`,
+				Required: []Term{{Text: "type:video"}, {Text: "link:@movies", Phrase: true}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := withQueryDefaults(tt.want)
+
+			if got := ParseQuery(tt.text); !reflect.DeepEqual(got, want) {
+				t.Fatalf("ParseQuery(%q) = %+v, want %+v", tt.text, got, want)
+			}
+		})
+	}
+}
+
+// withQueryDefaults 和 ParseQuery 一样把空切片初始化，方便用例只写关心的字段
+func withQueryDefaults(q Query) Query {
+	if q.Terms == nil {
+		q.Terms = []string{}
+	}
+	if q.Required == nil {
+		q.Required = []Term{}
+	}
+	if q.Excluded == nil {
+		q.Excluded = []Term{}
+	}
+	if q.Any == nil {
+		q.Any = [][]Term{}
+	}
+	if q.Unknown == nil {
+		q.Unknown = []string{}
+	}
+
+	return q
+}
+
+func TestTextQueryExcludedOnly(t *testing.T) {
+	fields := []string{"content"}
+
+	must, mustNot := ParseQuery("-广告 －“免费 领取”").textQuery(fields)
+
+	wantMust := []any{map[string]any{"match_all": map[string]any{}}}
+	if !reflect.DeepEqual(must, wantMust) {
+		t.Fatalf("must = %+v, want %+v", must, wantMust)
+	}
+
+	wantMustNot := []any{
+		multiMatch(fields, "广告", map[string]any{"type": "phrase"}),
+		multiMatch(fields, "免费 领取", map[string]any{"type": "phrase"}),
+	}
+	if !reflect.DeepEqual(mustNot, wantMustNot) {
+		t.Fatalf("must_not = %+v, want %+v", mustNot, wantMustNot)
+	}
+}
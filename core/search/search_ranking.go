@@ -0,0 +1,172 @@
+package search
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+)
+
+var _ranking = RankingConfig{}.withDefaults()
+
+// RankingConfig 消息排序的混合权重，最终得分 = relevance*BM25 + score + media + recency
+type RankingConfig struct {
+	Relevance float64 // 文本相关度
+	Score     float64 // 存储的 score，log1p
+	Media     float64 // videos/photos 数量，log1p
+	Recency   float64 // posted_at 的 gauss 衰减
+	Scale     string  // 衰减到 decay 的时间跨度，如 30d
+	Decay     float64
+}
+
+func (rc RankingConfig) withDefaults() RankingConfig {
+	if rc.Relevance == 0 && rc.Score == 0 && rc.Media == 0 && rc.Recency == 0 {
+		rc.Relevance, rc.Score, rc.Media, rc.Recency = 1, 1, 0.5, 1
+	}
+	if rc.Scale == "" {
+		rc.Scale = "30d"
+	}
+	if rc.Decay <= 0 || rc.Decay >= 1 {
+		rc.Decay = 0.5
+	}
+
+	return rc
+}
+
+// rank 用 function_score 在 BM25 之上叠加 score、媒体数和时效，origin 为时效的基准时间，毫秒
+func rank(query map[string]any, rc RankingConfig, origin int64) map[string]any {
+	if b, ok := query["bool"].(map[string]any); ok {
+		b["boost"] = rc.Relevance
+	}
+
+	return map[string]any{
+		"function_score": map[string]any{
+			"query": query,
+			"functions": []any{
+				map[string]any{
+					"field_value_factor": map[string]any{"field": "score", "modifier": "log1p", "missing": 0},
+					"weight":             rc.Score,
+				},
+				map[string]any{
+					"field_value_factor": map[string]any{"field": "videos", "modifier": "log1p", "missing": 0},
+					"weight":             rc.Media,
+				},
+				map[string]any{
+					"field_value_factor": map[string]any{"field": "photos", "modifier": "log1p", "missing": 0},
+					"weight":             rc.Media,
+				},
+				map[string]any{
+					// 没有 posted_at 的旧文档不参与时效加分
+					"filter": map[string]any{"exists": map[string]any{"field": "posted_at"}},
+					"gauss": map[string]any{
+						"posted_at": map[string]any{"origin": origin, "scale": rc.Scale, "decay": rc.Decay},
+					},
+					"weight": rc.Recency,
+				},
+			},
+			"score_mode": "sum",
+			"boost_mode": "sum",
+		},
+	}
+}
+
+const (
+	ProfileRelevance = "relevance"
+	ProfilePopular   = "popular"
+	ProfileNewest    = "newest"
+	ProfileMedia     = "media"
+)
+
+var (
+	ErrUnknownProfile = errors.New("unknown ranking profile")
+
+	_profiles = defaultProfiles()
+)
+
+// ProfileConfig 命名的排序方式，Sort 为 field:order，含 _score 时用 Ranking 打分
+type ProfileConfig struct {
+	Name    string
+	Label   string // 机器人按钮上的文字
+	Sort    []string
+	Ranking RankingConfig // 为空时使用全局权重
+}
+
+func defaultProfiles() []ProfileConfig {
+	return []ProfileConfig{
+		{Name: ProfileRelevance, Label: "🎯相关度", Sort: []string{"_score:desc"}},
+		{Name: ProfilePopular, Label: "🔥热门", Sort: []string{"score:desc", "videos:desc", "photos:desc"}},
+		{Name: ProfileNewest, Label: "🆕最新", Sort: []string{"posted_at:desc"}},
+		{Name: ProfileMedia, Label: "🎞️媒体最多", Sort: []string{"videos:desc", "photos:desc", "score:desc"}},
+	}
+}
+
+// Profiles 按配置顺序返回全部排序方式，第一个为默认
+func Profiles() []ProfileConfig {
+	return _profiles[:]
+}
+
+// Profile 按名字查找排序方式，名字为空时返回默认
+func Profile(name string) (ProfileConfig, bool) {
+	if name == "" {
+		return _profiles[0], true
+	}
+
+	for _, profile := range _profiles {
+		if profile.Name == name {
+			return profile, true
+		}
+	}
+
+	return ProfileConfig{}, false
+}
+
+// sorts 生成排序条件，末尾追加唯一的 tiebreaker，返回是否按 _score 排序
+func (pc ProfileConfig) sorts() ([]any, bool) {
+	sorts, scored := make([]any, 0, len(pc.Sort)+1), false
+
+	for _, item := range pc.Sort {
+		field, order, _ := strings.Cut(item, ":")
+		if order == "" {
+			order = "desc"
+		}
+
+		if field == "_score" {
+			scored = true
+			sorts = append(sorts, map[string]any{field: map[string]any{"order": order}})
+			continue
+		}
+
+		// 缺失字段排在最后，search_after 对缺失值仍然有序
+		// 读别名下还没有迁移的旧索引可能没有这个字段，不指定 unmapped_type 时这些分片会报错，结果里缺少旧文档
+		unmapped := "long"
+		if field == "posted_at" {
+			unmapped = "date"
+		}
+		sorts = append(sorts, map[string]any{field: map[string]any{"order": order, "missing": "_last", "unmapped_type": unmapped}})
+	}
+
+	return append(sorts, _tiebreaker), scored
+}
+
+// splitOrigin 打分排序的游标最后一项是 {"origin": 毫秒}，翻页时沿用首页的时效基准，跨过整点得分也不变，search_after 才稳定
+// 首页或旧游标返回当前小时
+func splitOrigin(sort []any) ([]any, int64) {
+	if len(sort) > 0 {
+		if m, ok := sort[len(sort)-1].(map[string]any); ok {
+			if origin := cast.ToInt64(m["origin"]); origin > 0 {
+				return sort[:len(sort)-1], origin
+			}
+		}
+	}
+
+	return sort, time.Now().Truncate(time.Hour).UnixMilli()
+}
+
+func (pc ProfileConfig) ranking() RankingConfig {
+	if pc.Ranking == (RankingConfig{}) {
+		return _ranking
+	}
+
+	return pc.Ranking.withDefaults()
+}
@@ -0,0 +1,371 @@
+package search
+
+import (
+	"context"
+	"fmt"
+	"jarvis/logger"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+const (
+	SeriesMessage     = "message"                // 滚动索引前缀，实际索引为 message-000001、message-000002 ...
+	AliasMessageWrite = SeriesMessage + "-write" // 写别名，只指向最新的一个索引
+)
+
+var (
+	_rollover = RolloverConfig{}
+	_rms      = map[string]*rolloverManager{}
+)
+
+type RolloverConfig struct {
+	Shards     uint64
+	Replicas   uint64
+	Interval   time.Duration
+	MaxAge     string // 如 7d
+	MaxDocs    uint64
+	MaxSize    string // 单个主分片大小，如 50gb
+	MaxIndices uint64 // 读别名下最多保留的滚动索引数，旧的单索引不计数，0 不清理
+}
+
+// conditions 转成 rollover 接口的条件，全部为空时返回空 map
+func (rc RolloverConfig) conditions() map[string]any {
+	conditions := make(map[string]any)
+
+	if rc.MaxAge != "" {
+		conditions["max_age"] = rc.MaxAge
+	}
+	if rc.MaxDocs > 0 {
+		conditions["max_docs"] = rc.MaxDocs
+	}
+	if rc.MaxSize != "" {
+		conditions["max_primary_shard_size"] = rc.MaxSize
+	}
+
+	return conditions
+}
+
+type RolloverStats struct {
+	Series       string    `json:"series"`
+	WriteIndex   string    `json:"write_index"`
+	Indices      []string  `json:"indices"`
+	LastRollover time.Time `json:"last_rollover"`
+	Failures     uint64    `json:"failures"`
+	LastError    string    `json:"last_error"`
+}
+
+func readAlias(series string) string  { return series + "-read" }
+func writeAlias(series string) string { return series + "-write" }
+
+// EnsureRollover 以模板 + 读写别名的方式管理一组滚动索引，mapping 的分片数由配置覆盖
+//  1. 模板 <series>-* 带上 mapping 和读别名，滚动出的新索引自动加入读别名
+//  2. 写别名不存在时创建 <series>-000001 作为写索引
+//  3. 旧的同名单索引并入读别名，数据在被清理前仍可搜到
+func EnsureRollover(series, mapping string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(10))
+	defer cancel()
+
+	template, err := templateBody(series, mapping)
+	if err != nil {
+		return err
+	}
+
+	if err = _backend.PutIndexTemplate(ctx, series, template); err != nil {
+		return err
+	}
+
+	indices, _, err := _backend.GetAlias(ctx, writeAlias(series))
+	if err != nil {
+		return err
+	}
+
+	if len(indices) == 0 {
+		bootstrap := fmt.Sprintf("%s-%06d", series, 1)
+
+		exist, err := _backend.IndexExists(ctx, bootstrap)
+		if err != nil {
+			return err
+		}
+
+		if exist {
+			err = _backend.UpdateAliases(ctx, []map[string]any{
+				{"add": map[string]any{"index": bootstrap, "alias": writeAlias(series), "is_write_index": true}},
+			})
+		} else {
+			err = _backend.CreateIndex(ctx, bootstrap, fmt.Sprintf(`{"aliases":{"%s":{"is_write_index":true}}}`, writeAlias(series)))
+		}
+		if err != nil {
+			return err
+		}
+
+		logger.App().Infof("bootstrap rollover index [%s] for [%s]", bootstrap, writeAlias(series))
+	}
+
+	legacy, err := _backend.IndexExists(ctx, series)
+	if err != nil {
+		return err
+	}
+
+	if legacy {
+		if err = ensureRankingFields(ctx, series, mapping); err != nil {
+			return err
+		}
+
+		if err = _backend.UpdateAliases(ctx, []map[string]any{
+			{"add": map[string]any{"index": series, "alias": readAlias(series)}},
+		}); err != nil {
+			return err
+		}
+
+		logger.App().Infof("legacy index [%s] joined [%s]", series, readAlias(series))
+	}
+
+	_rms[series] = newRolloverManager(series, _rollover)
+
+	return nil
+}
+
+// _rankingFields 打分和排序用到的字段，读别名下的索引缺少时 gauss 等函数会在这些分片上报错
+var _rankingFields = []string{"posted_at", "score", "videos", "photos"}
+
+// ensureRankingFields 旧的单索引加入读别名之前按 mapping 补上缺少的打分字段，旧文档没有值，不影响 _meta.version
+func ensureRankingFields(ctx context.Context, index, mapping string) error {
+	mappings, _, err := parseMapping(mapping)
+	if err != nil {
+		return err
+	}
+
+	current, err := _backend.GetMapping(ctx, index)
+	if err != nil {
+		return err
+	}
+
+	expected, _ := mappings["properties"].(map[string]any)
+	existing, _ := current[index]["properties"].(map[string]any)
+
+	missing := make(map[string]any)
+	for _, field := range _rankingFields {
+		if definition, ok := expected[field]; ok {
+			if _, exist := existing[field]; !exist {
+				missing[field] = definition
+			}
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	body, err := sonic.MarshalString(map[string]any{"properties": missing})
+	if err != nil {
+		return err
+	}
+
+	if err = _backend.PutMapping(ctx, index, body); err != nil {
+		return err
+	}
+
+	logger.App().Infof("legacy index [%s] add fields : %s", index, body)
+
+	return nil
+}
+
+// templateBody 把单索引的 settings/mappings 包装成索引模板
+func templateBody(series, mapping string) (string, error) {
+	var index map[string]any
+	if err := sonic.UnmarshalString(mapping, &index); err != nil {
+		return "", err
+	}
+
+	settings, _ := index["settings"].(map[string]any)
+	if settings == nil {
+		settings = make(map[string]any)
+	}
+	if _rollover.Shards > 0 {
+		settings["number_of_shards"] = _rollover.Shards
+	}
+	if _rollover.Replicas > 0 {
+		settings["number_of_replicas"] = _rollover.Replicas
+	}
+
+	return sonic.MarshalString(map[string]any{
+		"index_patterns": []string{series + "-*"},
+		"priority":       100,
+		"template": map[string]any{
+			"settings": settings,
+			"mappings": index["mappings"],
+			"aliases": map[string]any{
+				readAlias(series): map[string]any{},
+			},
+		},
+	})
+}
+
+type rolloverManager struct {
+	series     string
+	interval   time.Duration
+	conditions map[string]any
+	maxIndices uint64
+	close      chan struct{}
+	done       chan struct{}
+	mutex      *sync.Mutex
+	stats      RolloverStats
+}
+
+func newRolloverManager(series string, config RolloverConfig) *rolloverManager {
+	interval := config.Interval
+	if interval <= 0 {
+		interval = time.Minute * time.Duration(5)
+	}
+
+	return &rolloverManager{
+		series:     series,
+		interval:   interval,
+		conditions: config.conditions(),
+		maxIndices: config.MaxIndices,
+		close:      make(chan struct{}),
+		done:       make(chan struct{}),
+		mutex:      new(sync.Mutex),
+		stats:      RolloverStats{Series: series, Indices: make([]string, 0)},
+	}
+}
+
+func (rm *rolloverManager) Stats() RolloverStats {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	stats := rm.stats
+	stats.Indices = append([]string{}, rm.stats.Indices...)
+
+	return stats
+}
+
+func (rm *rolloverManager) Shutdown() {
+	close(rm.close)
+
+	<-rm.done
+}
+
+func (rm *rolloverManager) Start() {
+	logger.App().Infof("======================================== RolloverManager [%s] start ========================================", rm.series)
+	defer logger.App().Infof("======================================== RolloverManager [%s] stop ========================================", rm.series)
+
+	defer close(rm.done)
+
+	rm.retire()
+
+	// 没有任何条件时 rollover 会无条件滚动，直接不做
+	if len(rm.conditions) == 0 {
+		logger.App().Warnf("rollover of [%s] has no conditions, skip", rm.series)
+		<-rm.close
+		return
+	}
+
+	ticker := time.NewTicker(rm.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rm.close:
+			return
+		case <-ticker.C:
+			rm.rollover()
+			rm.retire()
+		}
+	}
+}
+
+func (rm *rolloverManager) rollover() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(30))
+	defer cancel()
+
+	index, err := _backend.Rollover(ctx, writeAlias(rm.series), rm.conditions)
+	if err != nil {
+		rm.fail(err)
+		logger.App().Errorf("rollover %s error : %s", writeAlias(rm.series), err.Error())
+		return
+	}
+
+	if index == "" {
+		return
+	}
+
+	rm.mutex.Lock()
+	rm.stats.LastRollover = time.Now()
+	rm.stats.LastError = ""
+	rm.mutex.Unlock()
+
+	logger.App().Infof("rollover %s to [%s]", writeAlias(rm.series), index)
+}
+
+// retire 刷新统计，读别名下索引超过上限时从最旧的开始删除，写索引不删
+func (rm *rolloverManager) retire() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(30))
+	defer cancel()
+
+	indices, _, err := _backend.GetAlias(ctx, readAlias(rm.series))
+	if err != nil {
+		rm.fail(err)
+		logger.App().Errorf("get alias %s error : %s", readAlias(rm.series), err.Error())
+		return
+	}
+
+	_, write, err := _backend.GetAlias(ctx, writeAlias(rm.series))
+	if err != nil {
+		rm.fail(err)
+		logger.App().Errorf("get alias %s error : %s", writeAlias(rm.series), err.Error())
+		return
+	}
+
+	// 只清理 <series>-000001 这样滚动出来的索引，旧的单索引不带后缀，不删也不计数
+	sort.Strings(indices)
+
+	rolled, kept := make([]string, 0, len(indices)), make([]string, 0, len(indices))
+	for _, index := range indices {
+		if rm.rolled(index) {
+			rolled = append(rolled, index)
+		} else {
+			kept = append(kept, index)
+		}
+	}
+
+	for rm.maxIndices > 0 && uint64(len(rolled)) > rm.maxIndices && rolled[0] != write {
+		if err = _backend.DeleteIndex(ctx, rolled[0]); err != nil {
+			rm.fail(err)
+			logger.App().Errorf("retire index %s error : %s", rolled[0], err.Error())
+			break
+		}
+
+		logger.App().Infof("retire index [%s] of [%s]", rolled[0], readAlias(rm.series))
+		rolled = rolled[1:]
+	}
+
+	rm.mutex.Lock()
+	rm.stats.WriteIndex = write
+	rm.stats.Indices = append(kept, rolled...)
+	rm.mutex.Unlock()
+}
+
+// rolled 是否为滚动出来的索引，迁移后的索引带 -v<版本> 后缀
+func (rm *rolloverManager) rolled(index string) bool {
+	suffix, ok := strings.CutPrefix(index, rm.series+"-")
+	if !ok {
+		return false
+	}
+
+	suffix, _, _ = strings.Cut(suffix, "-v")
+
+	return len(suffix) == 6 && strings.Trim(suffix, "0123456789") == ""
+}
+
+func (rm *rolloverManager) fail(err error) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	rm.stats.Failures++
+	rm.stats.LastError = err.Error()
+}
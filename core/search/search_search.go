@@ -1,13 +1,10 @@
 package search
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"errors"
 	"fmt"
-	"io"
-	"jarvis/dao/db/elasticsearch"
+	"jarvis/logger"
+	"maps"
 	"regexp"
 	"strings"
 	"time"
@@ -15,62 +12,225 @@ import (
 	"github.com/bytedance/sonic"
 )
 
+const (
+	IndexMessage = SeriesMessage + "-read" // 读别名，指向全部 message-* 滚动索引
+	IndexCog     = "cog"
+	IndexBot     = "bot"
+)
+
+// 保证翻页稳定的唯一排序字段，降级查询没有 _shard_doc 可用
+var _tiebreaker = map[string]any{
+	"id": map[string]any{
+		"order": "asc",
+	},
+}
+
+const (
+	CogTypeGroup   uint8 = 1
+	CogTypeChannel uint8 = 2
+)
+
+const (
+	SearchTypeBot   uint8 = 8
+	SearchTypeMedia uint8 = 9 // image+video
+)
+
 type SearchContent struct {
-	Content string `json:content`
-	Link    string `json:link`
+	Content string `json:"content"` // MarkdownV2
+	Text    string `json:"text"`    // 和 Content 相同的纯文本，用于 inline 结果等不能用 Markdown 的地方
+	Link    string `json:"link"`
+	Title   string `json:"title,omitempty"`
+	Members int    `json:"members,omitempty"`
 }
 
 type SearchResponse struct {
-	Content  []SearchContent `json:"content"`
-	LastSort []float64       `json:"last_sort"`
-	Next     bool            `json:"next"`
+	Content     []SearchContent `json:"content"`
+	LastSort    []any           `json:"last_sort"`
+	Next        bool            `json:"next"`
+	Degraded    bool            `json:"degraded"`    // 没有可用的 pit，结果来自直接查询索引
+	Profile     string          `json:"profile"`     // 实际使用的排序方式，只有消息搜索有
+	Type        uint8           `json:"type"`        // 实际的搜索类型，可能被 type: 操作符覆盖
+	Suggestions []string        `json:"suggestions"` // 首页结果为空或很少时的纠错建议，是改写后的完整输入
+}
+
+// clone 切片各自一份，共享的结果被一个调用方修改时不影响其他调用方
+func (sr *SearchResponse) clone() *SearchResponse {
+	response := *(sr)
+	response.Content = append([]SearchContent{}, sr.Content...)
+	response.Suggestions = append([]string{}, sr.Suggestions...)
+
+	response.LastSort = make([]any, 0, len(sr.LastSort))
+	for _, value := range sr.LastSort {
+		if m, ok := value.(map[string]any); ok {
+			value = maps.Clone(m)
+		}
+		response.LastSort = append(response.LastSort, value)
+	}
+
+	return &response
 }
 
 type Result struct {
 	Hits struct {
 		Hits []struct {
 			Source struct {
-				Link   string `json:"link"`
-				Photos int    `json:"photos"`
-				Videos int    `json:"videos"`
-				Voices int    `json:"voices"`
-				Files  int    `json:"files"`
+				Content string `json:"content"`
+				Link    string `json:"link"`
+				Photos  int    `json:"photos"`
+				Videos  int    `json:"videos"`
+				Voices  int    `json:"voices"`
+				Files   int    `json:"files"`
 			} `json:"_source"`
 			Highlight struct {
 				Content []string `json:"content"`
 			} `json:"highlight"`
-			Sort []float64 `json:"sort"`
+			Sort []any `json:"sort"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+type CogResult struct {
+	Hits struct {
+		Hits []struct {
+			Source struct {
+				Title    string `json:"title"`
+				Link     string `json:"link"`
+				Type     uint8  `json:"type"`
+				Members  int    `json:"members"`
+				Messages int    `json:"messages"`
+			} `json:"_source"`
+			Highlight struct {
+				Title []string `json:"title"`
+			} `json:"highlight"`
+			Sort []any `json:"sort"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+type BotResult struct {
+	Hits struct {
+		Hits []struct {
+			Source struct {
+				Username    string `json:"username"`
+				Description string `json:"description"`
+				Category    string `json:"category"`
+			} `json:"_source"`
+			Highlight struct {
+				Description []string `json:"description"`
+			} `json:"highlight"`
+			Sort []any `json:"sort"`
 		} `json:"hits"`
 	} `json:"hits"`
 }
 
-// all group channel text images videos voices files image+videos
-func Search(t uint8, text string, sort []float64) (*SearchResponse, error) {
-	pit := _pm.Get()
-	if pit == "" {
-		return nil, errors.New("empty pid")
+// Options 与用户相关的查询选项
+type Options struct {
+	NSFW     bool   // 用户关闭了安全搜索，允许返回标记为 nsfw 的内容
+	Profile  string // 排序方式，为空时使用默认，只对消息搜索生效
+	Language string // 用户语言，如 Telegram 的 language_code，对应语言的字段加权
+	// 发布时间范围，毫秒，[PostedFrom, PostedTo)，0 表示不限，只对消息搜索生效，没有 posted_at 的消息会被排除
+	PostedFrom int64
+	PostedTo   int64
+}
+
+// safeFilter 未开启 nsfw 时排除标记过的文档，没有 nsfw 字段的旧文档不受影响
+func safeFilter(options Options) []any {
+	if options.NSFW {
+		return []any{}
+	}
+
+	return []any{map[string]any{"term": map[string]any{"nsfw": true}}}
+}
+
+// all group channel videos images voices text files bots image+videos
+// text 中的操作符无法识别时返回 *OperatorError，type: 会覆盖 t
+func Search(t uint8, text string, sort []any, options Options) (*SearchResponse, error) {
+	key := _cache.key(t, text, sort, options)
+	if response, exist := _cache.get(key); exist {
+		return response, nil
+	}
+
+	// 热词被大量用户同时搜索时只查询一次
+	response, err, _ := _flight.do(key, func() (*SearchResponse, error) {
+		response, err := execute(t, text, sort, options)
+		if err == nil {
+			_cache.put(key, response)
+		}
+		return response, err
+	})
+
+	return response, err
+}
+
+func execute(t uint8, text string, sort []any, options Options) (*SearchResponse, error) {
+	query := ParseQuery(text)
+	if len(query.Unknown) > 0 {
+		return nil, &OperatorError{Operators: query.Unknown}
+	}
+
+	if query.Filters.Type != nil {
+		t = *(query.Filters.Type)
+	} else if (query.Filters.MinMembers > 0 || query.Filters.MinMessages > 0) && t != CogTypeGroup && t != CogTypeChannel {
+		// 成员数和消息数只有群组和频道有，没有指定类型时按群组搜
+		t = CogTypeGroup
+	}
+
+	// 指定了消息或机器人类型时成员数和消息数无法生效，和无法识别的操作符一样告诉用户
+	if t != CogTypeGroup && t != CogTypeChannel {
+		unsupported := make([]string, 0)
+		if query.Filters.MinMembers > 0 {
+			unsupported = append(unsupported, fmt.Sprintf("%s:%d", OperatorMinMembers, query.Filters.MinMembers))
+		}
+		if query.Filters.MinMessages > 0 {
+			unsupported = append(unsupported, fmt.Sprintf("%s:%d", OperatorMinMessages, query.Filters.MinMessages))
+		}
+		if len(unsupported) > 0 {
+			return nil, &OperatorError{Operators: unsupported}
+		}
+	}
+
+	var (
+		response *SearchResponse
+		err      error
+	)
+
+	switch t {
+	case CogTypeGroup, CogTypeChannel:
+		response, err = searchCog(t, query, sort, options)
+	case SearchTypeBot:
+		response, err = searchBot(query, sort)
+	default:
+		response, err = searchMessage(t, query, sort, options)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	response.Type = t
+	response.Suggestions = []string{}
+
+	if len(sort) == 0 && len(response.Content) < suggestSparse {
+		response.Suggestions = DidYouMean(t, text)
+	}
+
+	return response, nil
+}
+
+func searchMessage(t uint8, query Query, sort []any, options Options) (*SearchResponse, error) {
+	profile, exist := Profile(options.Profile)
+	if !exist {
+		return nil, ErrUnknownProfile
 	}
 
+	sorts, scored := profile.sorts()
+
+	sort, origin := splitOrigin(sort)
+
 	// 构建搜索体
 	condition := map[string]any{
 		"size": 10,
-		"sort": []any{
-			map[string]any{
-				"score": map[string]any{
-					"order": "desc",
-				},
-			},
-			map[string]any{
-				"videos": map[string]any{
-					"order": "desc",
-				},
-			},
-			map[string]any{
-				"photos": map[string]any{
-					"order": "desc",
-				},
-			},
-		},
+		"sort": sorts,
 		"highlight": map[string]any{
 			"pre_tags":  []string{"<em>"},
 			"post_tags": []string{"</em>"},
@@ -80,27 +240,15 @@ func Search(t uint8, text string, sort []float64) (*SearchResponse, error) {
 					"number_of_fragments": 1,
 				},
 			},
-		},
-		"pit": map[string]any{
-			"id":         pit,
-			"keep_alive": "5m",
+			// 语言子字段命中时也在 content 上高亮
+			"require_field_match": false,
 		},
 		"track_total_hits": false,
 	}
 
-	if sort != nil && len(sort) > 0 {
-		condition["search_after"] = sort
-	}
-
 	filter := make([]any, 0)
 
 	switch t {
-	case 1: // group
-		{
-		}
-	case 2: // channel
-		{
-		}
 	case 3: // videos
 		{
 			filter = append(filter, []any{
@@ -171,7 +319,7 @@ func Search(t uint8, text string, sort []float64) (*SearchResponse, error) {
 				map[string]any{"term": map[string]any{"voices": 0}},
 			}...)
 		}
-	case 8: // image+video
+	case SearchTypeMedia: // image+video
 		{
 			filter = append(filter, []any{
 				map[string]any{
@@ -197,47 +345,43 @@ func Search(t uint8, text string, sort []float64) (*SearchResponse, error) {
 		}
 	}
 
-	query := map[string]any{
-		"bool": map[string]any{
-			"must": []any{
-				map[string]any{
-					"match": map[string]any{
-						"content": text,
-					},
-				},
-			},
-			"filter": filter,
-		},
+	if options.PostedFrom > 0 || options.PostedTo > 0 {
+		bounds := make(map[string]any)
+		if options.PostedFrom > 0 {
+			bounds["gte"] = options.PostedFrom
+		}
+		if options.PostedTo > 0 {
+			bounds["lt"] = options.PostedTo
+		}
+		filter = append(filter, map[string]any{"range": map[string]any{"posted_at": bounds}})
 	}
 
-	condition["query"] = query
-
-	// 序列化为 JSON
-	var buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(condition); err != nil {
-		return nil, err
+	// 消息的 link 是 /channel/id
+	if query.Filters.Link != "" {
+		filter = append(filter, map[string]any{"prefix": map[string]any{"link": query.Filters.Link + "/"}})
 	}
 
-	// 构建 Search 请求
-	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*time.Duration(3000))
-	defer cancel()
-	res, err := elasticsearch.Instance().Search(
-		elasticsearch.Instance().Search.WithContext(ctx),
-		elasticsearch.Instance().Search.WithBody(&buf),
-		elasticsearch.Instance().Search.WithPretty(),
-	)
-	if err != nil {
-		return nil, err
+	must, mustNot := query.textQuery(languageFields("content", options.Language))
+
+	boolQuery := map[string]any{
+		"bool": map[string]any{
+			"must":   must,
+			"should": languageBoost(options.Language),
+			// should 只用来加分，没有 must 时也不要求命中
+			"minimum_should_match": 0,
+			"filter":               filter,
+			"must_not":             append(append(blockFilter(SeriesMessage), safeFilter(options)...), mustNot...),
+		},
 	}
-	defer func() { _ = res.Body.Close() }()
 
-	if res.IsError() {
-		return nil, errors.New(fmt.Sprintf("%s : %s", res.Status(), res.String()))
+	condition["query"] = boolQuery
+	if scored {
+		condition["query"] = rank(boolQuery, profile.ranking(), origin)
 	}
 
-	data, raErr := io.ReadAll(res.Body)
-	if raErr != nil {
-		return nil, raErr
+	data, degraded, err := doSearch(IndexMessage, condition, sort)
+	if err != nil {
+		return nil, err
 	}
 
 	result := new(Result)
@@ -245,12 +389,15 @@ func Search(t uint8, text string, sort []float64) (*SearchResponse, error) {
 		return nil, err
 	}
 
-	response := &SearchResponse{Content: make([]SearchContent, 0), LastSort: make([]float64, 0), Next: len(result.Hits.Hits) >= 10}
+	response := &SearchResponse{Content: make([]SearchContent, 0), LastSort: make([]any, 0), Next: len(result.Hits.Hits) >= 10, Degraded: degraded, Profile: profile.Name}
 
 	if result.Hits.Hits != nil && len(result.Hits.Hits) != 0 {
 		for idx, hit := range result.Hits.Hits {
-			content := processHighlight(hit.Highlight.Content[0])
-			content = EscapeMarkdownV2(content)
+			content := hit.Source.Content
+			if len(hit.Highlight.Content) > 0 {
+				content = hit.Highlight.Content[0]
+			}
+			content = processHighlight(content)
 
 			prefix := "💬"
 			if hit.Source.Videos > 0 {
@@ -264,12 +411,16 @@ func Search(t uint8, text string, sort []float64) (*SearchResponse, error) {
 			}
 
 			response.Content = append(response.Content, SearchContent{
-				Content: prefix + content,
+				Content: prefix + EscapeMarkdownV2(content),
+				Text:    prefix + content,
 				Link:    fmt.Sprintf("https://t.me%s", hit.Source.Link),
 			})
 
 			if idx == (len(result.Hits.Hits) - 1) {
 				response.LastSort = hit.Sort
+				if scored {
+					response.LastSort = append(hit.Sort, map[string]any{"origin": origin})
+				}
 			}
 		}
 	}
@@ -277,6 +428,229 @@ func Search(t uint8, text string, sort []float64) (*SearchResponse, error) {
 	return response, nil
 }
 
+func searchCog(t uint8, query Query, sort []any, options Options) (*SearchResponse, error) {
+	must, mustNot := query.textQuery(languageFields("title", options.Language))
+
+	filter := []any{
+		map[string]any{"term": map[string]any{"type": t}},
+	}
+
+	if query.Filters.Link != "" {
+		filter = append(filter, map[string]any{"term": map[string]any{"link": query.Filters.Link}})
+	}
+
+	if query.Filters.MinMembers > 0 {
+		filter = append(filter, map[string]any{"range": map[string]any{"members": map[string]any{"gte": query.Filters.MinMembers}}})
+	}
+
+	if query.Filters.MinMessages > 0 {
+		filter = append(filter, map[string]any{"range": map[string]any{"messages": map[string]any{"gte": query.Filters.MinMessages}}})
+	}
+
+	// 按成员数和活跃度排序
+	condition := map[string]any{
+		"size": 10,
+		"sort": []any{
+			map[string]any{
+				"members": map[string]any{
+					"order": "desc",
+				},
+			},
+			map[string]any{
+				"messages": map[string]any{
+					"order": "desc",
+				},
+			},
+			_tiebreaker,
+		},
+		"highlight": map[string]any{
+			"pre_tags":  []string{"<em>"},
+			"post_tags": []string{"</em>"},
+			"fields": map[string]any{
+				"title": map[string]any{
+					"number_of_fragments": 0,
+				},
+			},
+			"require_field_match": false,
+		},
+		"track_total_hits": false,
+		"query": map[string]any{
+			"bool": map[string]any{
+				"must":   must,
+				"should": languageBoost(options.Language),
+				// should 只用来加分，没有 must 时也不要求命中
+				"minimum_should_match": 0,
+				"filter":               filter,
+				"must_not":             append(append(blockFilter(IndexCog), safeFilter(options)...), mustNot...),
+			},
+		},
+	}
+
+	data, degraded, err := doSearch(IndexCog, condition, sort)
+	if err != nil {
+		return nil, err
+	}
+
+	result := new(CogResult)
+	if err = sonic.Unmarshal(data, result); err != nil {
+		return nil, err
+	}
+
+	response := &SearchResponse{Content: make([]SearchContent, 0), LastSort: make([]any, 0), Next: len(result.Hits.Hits) >= 10, Degraded: degraded}
+
+	prefix := "👥"
+	if t == CogTypeChannel {
+		prefix = "📢"
+	}
+
+	for idx, hit := range result.Hits.Hits {
+		title := hit.Source.Title
+		if len(hit.Highlight.Title) > 0 {
+			title = hit.Highlight.Title[0]
+		}
+		title = fmt.Sprintf("%s %s人", substringByRune(cleanContent(title), 0, 25), formatCount(hit.Source.Members))
+
+		response.Content = append(response.Content, SearchContent{
+			Content: prefix + EscapeMarkdownV2(title),
+			Text:    prefix + title,
+			Link:    fmt.Sprintf("https://t.me%s", hit.Source.Link),
+			Title:   hit.Source.Title,
+			Members: hit.Source.Members,
+		})
+
+		if idx == (len(result.Hits.Hits) - 1) {
+			response.LastSort = hit.Sort
+		}
+	}
+
+	return response, nil
+}
+
+func searchBot(query Query, sort []any) (*SearchResponse, error) {
+	must, mustNot := query.textQuery([]string{"description", "username.text"})
+
+	condition := map[string]any{
+		"size": 10,
+		"sort": []any{
+			map[string]any{
+				"score": map[string]any{
+					"order": "desc",
+				},
+			},
+			_tiebreaker,
+		},
+		"highlight": map[string]any{
+			"pre_tags":  []string{"<em>"},
+			"post_tags": []string{"</em>"},
+			"fields": map[string]any{
+				"description": map[string]any{
+					"fragment_size":       30,
+					"number_of_fragments": 1,
+				},
+			},
+		},
+		"track_total_hits": false,
+		"query": map[string]any{
+			"bool": map[string]any{
+				// 分类只按去掉操作符后的原文精确匹配
+				"should": []any{
+					map[string]any{"bool": map[string]any{"must": must}},
+					map[string]any{"term": map[string]any{"category": query.Text}},
+				},
+				"minimum_should_match": 1,
+				"must_not":             append(blockFilter(IndexBot), mustNot...),
+			},
+		},
+	}
+
+	data, degraded, err := doSearch(IndexBot, condition, sort)
+	if err != nil {
+		return nil, err
+	}
+
+	result := new(BotResult)
+	if err = sonic.Unmarshal(data, result); err != nil {
+		return nil, err
+	}
+
+	response := &SearchResponse{Content: make([]SearchContent, 0), LastSort: make([]any, 0), Next: len(result.Hits.Hits) >= 10, Degraded: degraded}
+
+	for idx, hit := range result.Hits.Hits {
+		description := hit.Source.Description
+		if len(hit.Highlight.Description) > 0 {
+			description = hit.Highlight.Description[0]
+		}
+
+		text := fmt.Sprintf("@%s %s", hit.Source.Username, processHighlight(description))
+
+		response.Content = append(response.Content, SearchContent{
+			Content: "🤖" + EscapeMarkdownV2(text),
+			Text:    "🤖" + text,
+			Link:    fmt.Sprintf("https://t.me/%s", hit.Source.Username),
+			Title:   hit.Source.Username,
+		})
+
+		if idx == (len(result.Hits.Hits) - 1) {
+			response.LastSort = hit.Sort
+		}
+	}
+
+	return response, nil
+}
+
+// doSearch 优先在 pit 上查询，没有可用 pit 时降级为直接查询索引
+// pit 查询的游标比 sort 多一个隐式的 _shard_doc，降级查询的游标在 pit 恢复后继续走降级查询
+func doSearch(index string, condition map[string]any, sort []any) ([]byte, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*time.Duration(3000))
+	defer cancel()
+
+	fields := len(condition["sort"].([]any))
+
+	// pit 的游标比排序字段多一个 _shard_doc，不带 pit 的游标不能转换成 pit 的，只能继续直接查索引
+	pit := getPIT(index)
+	switch {
+	case pit == nil:
+		logger.App().Warnf("search %s degrade : no pit available", index)
+	case len(sort) > 0 && len(sort) <= fields:
+		logger.App().Warnf("search %s degrade : cursor is from a search without pit", index)
+	default:
+		condition["pit"] = pit
+		if len(sort) > 0 {
+			condition["search_after"] = sort
+		}
+
+		data, err := _backend.Search(ctx, "", condition)
+		if err == nil || !strings.HasPrefix(err.Error(), "404") {
+			return data, false, err
+		}
+
+		logger.App().Warnf("search %s degrade : pit expired - %s", index, err.Error())
+		delete(condition, "pit")
+		delete(condition, "search_after")
+	}
+
+	// pit 的游标去掉 _shard_doc 后按同样的排序字段直接查索引
+	if len(sort) > fields {
+		sort = sort[:fields]
+	}
+	if len(sort) > 0 {
+		condition["search_after"] = sort
+	}
+
+	data, err := _backend.Search(ctx, index, condition)
+
+	return data, true, err
+}
+
+// formatCount 将成员数格式化为 1.2万 这样的短格式
+func formatCount(n int) string {
+	if n < 10000 {
+		return fmt.Sprintf("%d", n)
+	}
+
+	return strings.TrimSuffix(fmt.Sprintf("%.1f", float64(n)/10000), ".0") + "万"
+}
+
 // EscapeMarkdownV2 将输入文本转义为MarkdownV2格式
 // MarkdownV2是Telegram Bot API使用的Markdown格式
 // 需要转义的字符: _ * [ ] ( ) ~ ` > # + - = | { } . !
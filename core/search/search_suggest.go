@@ -0,0 +1,299 @@
+package search
+
+import (
+	"context"
+	"jarvis/logger"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+const (
+	suggestSparse = 3 // 首页结果少于这个数时给出纠错建议
+	suggestLimit  = 3
+)
+
+var (
+	_vocabulary = make(map[string]int64)
+	_vocabMutex = new(sync.RWMutex)
+)
+
+type suggestResult struct {
+	Suggest map[string][]struct {
+		Text    string `json:"text"`
+		Options []struct {
+			Text  string  `json:"text"`
+			Score float64 `json:"score"`
+			Freq  int64   `json:"freq"`
+		} `json:"options"`
+	} `json:"suggest"`
+}
+
+type suggestion struct {
+	text  string
+	score float64
+}
+
+// SetVocabulary 替换兜底纠错用的词频表，来自 SearchHash
+func SetVocabulary(words map[string]int64) {
+	_vocabMutex.Lock()
+	defer _vocabMutex.Unlock()
+
+	_vocabulary = words
+}
+
+// DidYouMean 先用 ES term suggester，没有结果时按词频表里编辑距离最近的词纠错，返回改写后的完整输入
+func DidYouMean(t uint8, text string) []string {
+	index, field := IndexMessage, "content"
+	switch t {
+	case CogTypeGroup, CogTypeChannel:
+		index, field = IndexCog, "title"
+	case SearchTypeBot:
+		return []string{}
+	}
+
+	// 操作符不参与纠错，改写时原样保留
+	query := ParseQuery(text)
+	if query.Text == "" {
+		return []string{}
+	}
+
+	suggestions, err := suggestTerms(index, field, query.Text)
+	if err != nil {
+		logger.App().Errorf("suggest [%s] on %s error : %s", text, index, err.Error())
+	}
+
+	if len(suggestions) == 0 {
+		suggestions = suggestVocabulary(query.Text)
+	}
+
+	sort.SliceStable(suggestions, func(i, j int) bool { return suggestions[i].score > suggestions[j].score })
+
+	result, seen := make([]string, 0, suggestLimit), make(map[string]struct{})
+	for _, item := range suggestions {
+		corrected := strings.Replace(text, query.Text, item.text, 1)
+		if _, exist := seen[corrected]; exist || corrected == text {
+			continue
+		}
+		seen[corrected] = struct{}{}
+
+		if result = append(result, corrected); len(result) >= suggestLimit {
+			break
+		}
+	}
+
+	return result
+}
+
+func suggestTerms(index, field, text string) ([]suggestion, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*time.Duration(1000))
+	defer cancel()
+
+	data, err := _backend.Search(ctx, index, map[string]any{
+		"size": 0,
+		"suggest": map[string]any{
+			"text": text,
+			"correction": map[string]any{
+				"term": map[string]any{
+					"field":        field,
+					"suggest_mode": "popular",
+					"sort":         "frequency",
+					"size":         suggestLimit,
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := new(suggestResult)
+	if err = sonic.Unmarshal(data, result); err != nil {
+		return nil, err
+	}
+
+	suggestions := make([]suggestion, 0)
+	for _, token := range result.Suggest["correction"] {
+		if !strings.Contains(text, token.Text) {
+			continue
+		}
+		for _, option := range token.Options {
+			suggestions = append(suggestions, suggestion{
+				text:  strings.Replace(text, token.Text, option.Text, 1),
+				score: option.Score * float64(option.Freq),
+			})
+		}
+	}
+
+	return suggestions, nil
+}
+
+// suggestVocabulary 每个分词在词频表中找编辑距离最小、频率最高的词替换
+func suggestVocabulary(text string) []suggestion {
+	tokens, err := Analyze(text)
+	if err != nil {
+		logger.App().Errorf("analyze [%s] error : %s", text, err.Error())
+		return []suggestion{}
+	}
+
+	_vocabMutex.RLock()
+	defer _vocabMutex.RUnlock()
+
+	suggestions := make([]suggestion, 0)
+
+	for _, token := range tokens {
+		runes := []rune(token)
+		if len(runes) < 2 || !strings.Contains(text, token) {
+			continue
+		}
+		if _, exist := _vocabulary[token]; exist {
+			continue
+		}
+
+		// 短词只允许错一个字
+		limit := 1
+		if len(runes) > 4 {
+			limit = 2
+		}
+
+		for word, freq := range _vocabulary {
+			candidate := []rune(word)
+			if len(candidate) < len(runes)-limit || len(candidate) > len(runes)+limit {
+				continue
+			}
+
+			distance := editDistance(runes, candidate)
+			if distance == 0 || distance > limit {
+				continue
+			}
+
+			suggestions = append(suggestions, suggestion{
+				text:  strings.Replace(text, token, word, 1),
+				score: float64(freq) / float64(distance),
+			})
+		}
+	}
+
+	return suggestions
+}
+
+// editDistance 按字计算的 Levenshtein 距离
+func editDistance(a, b []rune) int {
+	previous, current := make([]int, len(b)+1), make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
+
+// ================================================================================================
+
+const completionMaxInput = 50 // 和 completion 字段默认的 max_input_length 一致
+
+type completionResult struct {
+	Suggest map[string][]struct {
+		Options []struct {
+			Text   string         `json:"text"`
+			Score  float64        `json:"_score"`
+			Source map[string]any `json:"_source"`
+		} `json:"options"`
+	} `json:"suggest"`
+}
+
+// completionInput 生成 completion 字段，weight 必须是非负的 int32
+func completionInput(input string, weight int) map[string]any {
+	return map[string]any{
+		"input":  substringByRune(strings.TrimSpace(input), 0, completionMaxInput),
+		"weight": min(max(weight, 0), math.MaxInt32),
+	}
+}
+
+func firstLine(text string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(text), "\n")
+	return line
+}
+
+// Complete 从群组/频道和消息的 completion 字段中取前缀补全，按权重排序，屏蔽的内容不返回
+func Complete(prefix string, size int) ([]string, error) {
+	prefix = strings.TrimSpace(prefix)
+	if prefix == "" || size <= 0 {
+		return []string{}, nil
+	}
+
+	type scored struct {
+		text  string
+		score float64
+	}
+
+	items := make([]scored, 0)
+
+	for _, target := range []struct{ index, series string }{{IndexCog, IndexCog}, {IndexMessage, SeriesMessage}} {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*time.Duration(1000))
+		data, err := _backend.Search(ctx, target.index, map[string]any{
+			"size":    0,
+			"_source": []string{"id", "link"},
+			"suggest": map[string]any{
+				"completion": map[string]any{
+					"prefix": prefix,
+					"completion": map[string]any{
+						"field":           "suggest",
+						"size":            size,
+						"skip_duplicates": true,
+					},
+				},
+			},
+		})
+		cancel()
+
+		if err != nil {
+			return nil, err
+		}
+
+		result := new(completionResult)
+		if err = sonic.Unmarshal(data, result); err != nil {
+			return nil, err
+		}
+
+		for _, suggest := range result.Suggest["completion"] {
+			for _, option := range suggest.Options {
+				if blocked(target.series, option.Source) {
+					continue
+				}
+				items = append(items, scored{text: option.Text, score: option.Score})
+			}
+		}
+	}
+
+	sort.SliceStable(items, func(i, j int) bool { return items[i].score > items[j].score })
+
+	completions, seen := make([]string, 0, size), make(map[string]struct{})
+	for _, item := range items {
+		if _, exist := seen[item.text]; exist {
+			continue
+		}
+		seen[item.text] = struct{}{}
+
+		if completions = append(completions, item.text); len(completions) >= size {
+			break
+		}
+	}
+
+	return completions, nil
+}
@@ -0,0 +1,26 @@
+package search
+
+import (
+	"context"
+	"jarvis/logger"
+	"time"
+)
+
+// SynonymSet mapping 中 synonym_graph 过滤器引用的同义词集合，必须在建索引之前存在
+const SynonymSet = "search-synonyms"
+
+// SetSynonyms 整体替换同义词，只用在查询分析器上，更新后不需要重建索引
+func SetSynonyms(rules []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(10))
+	defer cancel()
+
+	if err := _backend.PutSynonyms(ctx, SynonymSet, rules); err != nil {
+		return err
+	}
+
+	logger.App().Infof("put synonyms [%s] : %d", SynonymSet, len(rules))
+
+	_cache.version("synonym", fingerprint(rules))
+
+	return nil
+}
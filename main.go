@@ -13,7 +13,9 @@ import (
 	"path/filepath"
 	"search-service/config"
 	"search-service/core"
+	"search-service/core/search"
 	"syscall"
+	"time"
 
 	"github.com/duke-git/lancet/v2/fileutil"
 )
@@ -21,6 +23,7 @@ import (
 var (
 	cfd = flag.String("cfd", "config", "dir of configurations")
 	cff = flag.String("cff", "default.yaml", "configuration file")
+	mgi = flag.String("migrate", "", "migrate the index (cog/message/bot) to the current mapping and exit")
 )
 
 func init() {
@@ -42,6 +45,13 @@ func init() {
 		panic(fmt.Sprintf("failed to initialize cache: %s", err.Error()))
 	}
 
+	if *mgi != "" {
+		if err := migrate(*mgi); err != nil {
+			panic(fmt.Sprintf("failed to migrate [%s]: %s", *mgi, err.Error()))
+		}
+		os.Exit(0)
+	}
+
 	if err := initService(); err != nil {
 		panic(fmt.Sprintf("failed to initialize service: %s", err.Error()))
 	}
@@ -172,9 +182,111 @@ func initService() error {
 	if err := core.Init(
 		config.Instance().Web.Prefix,
 		config.Instance().Web.Address,
+		adminConfig(),
+		searchConfig(),
+		poolConfig(),
+		core.MissionConfig{
+			Mode:       config.Instance().Mission.Mode,
+			Stream:     config.Instance().Mission.Stream,
+			Durable:    config.Instance().Mission.Durable,
+			MaxDeliver: config.Instance().Mission.MaxDeliver,
+			AckWait:    time.Second * time.Duration(config.Instance().Mission.AckWait),
+			NakDelay:   time.Millisecond * time.Duration(config.Instance().Mission.NakDelay),
+			DeadLetter: config.Instance().Mission.DeadLetter,
+		},
 	); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+func searchConfig() search.Config {
+	pits := make([]search.PITConfig, 0)
+	for _, pit := range config.Instance().Search.PIT {
+		pits = append(pits, search.PITConfig{
+			Index:     pit.Index,
+			Pool:      pit.Pool,
+			KeepAlive: time.Second * time.Duration(pit.KeepAlive),
+			Rotation:  time.Second * time.Duration(pit.Rotation),
+		})
+	}
+
+	profiles := make([]search.ProfileConfig, 0)
+	for _, profile := range config.Instance().Search.Profiles {
+		profiles = append(profiles, search.ProfileConfig{
+			Name:    profile.Name,
+			Label:   profile.Label,
+			Sort:    profile.Sort[:],
+			Ranking: rankingConfig(profile.Ranking),
+		})
+	}
+
+	return search.Config{
+		PIT: pits,
+		Rollover: search.RolloverConfig{
+			Shards:     config.Instance().Search.Rollover.Shards,
+			Replicas:   config.Instance().Search.Rollover.Replicas,
+			Interval:   time.Second * time.Duration(config.Instance().Search.Rollover.Interval),
+			MaxAge:     config.Instance().Search.Rollover.MaxAge,
+			MaxDocs:    config.Instance().Search.Rollover.MaxDocs,
+			MaxSize:    config.Instance().Search.Rollover.MaxSize,
+			MaxIndices: config.Instance().Search.Rollover.MaxIndices,
+		},
+		Ingest: search.IngestConfig{
+			BatchSize:  config.Instance().Search.Ingest.BatchSize,
+			Interval:   time.Millisecond * time.Duration(config.Instance().Search.Ingest.Interval),
+			MaxRetries: config.Instance().Search.Ingest.MaxRetries,
+			Queue:      config.Instance().Search.Ingest.Queue,
+		},
+		Ranking:  rankingConfig(config.Instance().Search.Ranking),
+		Profiles: profiles,
+		Cache: search.CacheConfig{
+			Size:  config.Instance().Search.Cache.Size,
+			TTL:   time.Second * time.Duration(config.Instance().Search.Cache.TTL),
+			Redis: config.Instance().Search.Cache.Redis,
+		},
+	}
+}
+
+func adminConfig() []core.AdminConfig {
+	admins := make([]core.AdminConfig, 0)
+	for _, admin := range config.Instance().Web.Admins {
+		admins = append(admins, core.AdminConfig{Name: admin.Name, Token: admin.Token})
+	}
+
+	return admins
+}
+
+func poolConfig() []core.PoolConfig {
+	pools := make([]core.PoolConfig, 0)
+	for _, pool := range config.Instance().Worker.Pools {
+		pools = append(pools, core.PoolConfig{
+			Name:    pool.Name,
+			Workers: pool.Workers,
+			Queue:   pool.Queue,
+		})
+	}
+
+	return pools
+}
+
+func rankingConfig(ranking config.Ranking) search.RankingConfig {
+	return search.RankingConfig{
+		Relevance: ranking.Relevance,
+		Score:     ranking.Score,
+		Media:     ranking.Media,
+		Recency:   ranking.Recency,
+		Scale:     ranking.Scale,
+		Decay:     ranking.Decay,
+	}
+}
+
+// migrate 只依赖 elasticsearch，不启动服务
+func migrate(index string) error {
+	if err := search.Init(searchConfig()); err != nil {
+		return err
+	}
+
+	return core.Migrate(index)
+}